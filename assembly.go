@@ -0,0 +1,80 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// SetLineAssemblyTimeout caps how long we wait for a line to
+// be finished: if a partial line has been accumulating for d
+// without its delimiter arriving, it is stored (and handed
+// on) as it stands, as though it were complete, and the rest
+// of it makes a new line. This is for children that start a
+// line and never end it, while still writing, such as a
+// progress display that rewrites one line with '\r'; unlike
+// OnIdle, which notices no output at all. The check is made
+// as output arrives, so a partial line followed by silence
+// waits, as ever, for more output or EOF. Stats() counts the
+// lines flushed early. d <= 0, the default, means no limit.
+// Call it before Exec.
+func (c *CaptureOuts) SetLineAssemblyTimeout(d time.Duration) {
+	c.mut.Lock()
+	c.assemblyTimeout = d
+	c.mut.Unlock()
+}
+
+// readAssembling is the loop of a capture goroutine under
+// SetLineAssemblyTimeout: it reads whatever r has, rather
+// than a whole line at a time, so that it gets to check the
+// age of the partial line as each read completes.
+func (c *CaptureOuts) readAssembling(r io.Reader, a Stream, stage int, delim byte, d time.Duration) {
+	buf := make([]byte, 64<<10)
+	var half bytes.Buffer
+	var since time.Time // when half got its first byte.
+	for {
+		if c.CaptureStopped() {
+			// drain, so the child doesn't block writing to us.
+			io.Copy(io.Discard, r)
+			return
+		}
+		n, err := r.Read(buf)
+		p := buf[:n]
+		for len(p) > 0 {
+			i := bytes.IndexByte(p, delim)
+			if i < 0 {
+				if half.Len() == 0 {
+					since = time.Now()
+				}
+				half.Write(p)
+				break
+			}
+			if half.Len() > 0 {
+				half.Write(p[:i+1])
+				c.addLine(half.String(), a, stage)
+				half = bytes.Buffer{}
+			} else {
+				c.addLine(string(p[:i+1]), a, stage)
+			}
+			p = p[i+1:]
+		}
+		if half.Len() > 0 && time.Since(since) >= d {
+			c.mut.Lock()
+			c.forceFlushed++
+			c.mut.Unlock()
+			c.addLine(half.String(), a, stage)
+			half = bytes.Buffer{}
+		}
+		if err != nil {
+			// as in captureWG: flush any final unterminated
+			// line, and stop.
+			if half.Len() > 0 {
+				c.addLine(half.String(), a, stage)
+			}
+			if err != io.EOF {
+				c.noteReadError(a, err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package capture
+
+import (
+	"fmt"
+	"os"
+)
+
+// AttachPID attaches to the stdout and stderr of an already
+// running process that we did not start ourselves, by opening
+// /proc/<pid>/fd/1 and /proc/<pid>/fd/2 for reading. Like Exec,
+// it blocks until capture is complete, and should typically be
+// run on its own goroutine while another goroutine monitors
+// progress with c.BytesSoFar() or c.GetComboOutSoFar().
+//
+// Platform limits: this is only available on Linux, since it
+// relies on /proc. We need permission to open the target's file
+// descriptors (the same user, or CAP_SYS_PTRACE). Only streams
+// that are pipes/FIFOs or regular files can be attached.
+// Terminals and other character devices are skipped, since
+// reading from them would steal the user's keyboard input, and
+// sockets cannot be re-opened through /proc at all. If the
+// stream is a pipe that someone else is already reading (a shell
+// pipeline, say), we compete with that reader: each chunk of
+// output goes to only one of us. If the stream is a regular file,
+// we capture whatever the file holds, from its beginning.
+//
+// Because the process is not our child, we cannot wait on it.
+// Instead c.Done is closed once every attached stream reaches
+// EOF, which for a pipe means all of its writers (normally just
+// the process) have exited.
+//
+// If neither stream can be attached, AttachPID returns a
+// descriptive error, also stored in c.Err.
+func (c *CaptureOuts) AttachPID(pid int) error {
+	c.mut.Lock()
+	c.cmdLine = fmt.Sprintf("(attached to pid %v)", pid)
+	c.pid = pid
+	c.mut.Unlock()
+	c.startSlogger(fmt.Sprintf("pid %v", pid))
+
+	var files []*os.File
+	var reasons []string
+	for fd := 1; fd <= 2; fd++ {
+		f, err := openProcFd(pid, fd)
+		if err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		files = append(files, f)
+		stream := Stderr
+		if fd == 1 {
+			stream = Stdout
+		}
+		c.capture(f, stream)
+	}
+	if len(files) == 0 {
+		return c.finish(fmt.Errorf("error in CaptureOuts.AttachPID(%v): could not attach to stdout or stderr: %v", pid, reasons))
+	}
+	c.mut.Lock()
+	c.running = true
+	c.mut.Unlock()
+
+	c.wg.Wait()
+	for _, f := range files {
+		f.Close()
+	}
+	return c.finish(nil)
+}
+
+// openProcFd opens /proc/<pid>/fd/<fd> for reading, if it
+// refers to something we can safely read from.
+func openProcFd(pid, fd int) (*os.File, error) {
+	path := fmt.Sprintf("/proc/%v/fd/%v", pid, fd)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat '%s': '%v'", path, err)
+	}
+	mode := fi.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0, mode.IsRegular():
+	case mode&os.ModeCharDevice != 0:
+		return nil, fmt.Errorf("'%s' is a terminal or character device; not attaching", path)
+	default:
+		return nil, fmt.Errorf("'%s' has unsupported file type '%v'", path, mode.Type())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open '%s': '%v'", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package capture
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// AttachPID is only supported on Linux, where the target's
+// stdout and stderr can be reached through /proc/<pid>/fd.
+// Elsewhere it returns a descriptive error, also stored in
+// c.Err, and closes c.Done.
+func (c *CaptureOuts) AttachPID(pid int) error {
+	return c.finish(fmt.Errorf("error in CaptureOuts.AttachPID(%v): attaching to an existing process is not supported on %v", pid, runtime.GOOS))
+}
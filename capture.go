@@ -3,37 +3,929 @@ package capture
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/creack/pty"
+	"golang.org/x/text/encoding"
+)
+
+// ErrStartFailed and ErrWaitFailed are wrapped by the errors
+// that Exec (and friends) return, and store in c.Err, when
+// cmd.Start() or cmd.Wait() fails, respectively. The
+// underlying error is wrapped too, so callers can use
+// errors.Is and errors.As to tell, say, a binary that could
+// not be started apart from one that exited non-zero
+// (an *exec.ExitError).
+var (
+	ErrStartFailed = errors.New("cmd.Start() failed")
+	ErrWaitFailed  = errors.New("cmd.Wait() failed")
 )
 
+// ErrReadFailed is wrapped by the error in c.Err when reading
+// the child's output failed with an error other than io.EOF,
+// cutting the capture short. See SetKillOnReadError.
+var ErrReadFailed = errors.New("reading output failed")
+
+// ErrStderrOutput is wrapped by the error in c.Err when
+// SetKillOnStderr(true) has killed the process because it
+// wrote to stderr. Use errors.As with a *StderrOutputError
+// to get the offending line.
+var ErrStderrOutput = errors.New("output on stderr")
+
+// StderrOutputError records the first stderr line, which
+// with SetKillOnStderr(true) caused the process to be killed.
+type StderrOutputError struct {
+	Line string
+}
+
+func (e *StderrOutputError) Error() string {
+	return fmt.Sprintf("%v: %q", ErrStderrOutput, e.Line)
+}
+
+func (e *StderrOutputError) Unwrap() error {
+	return ErrStderrOutput
+}
+
 // CaptureOuts and its Exec() method provide for starting a process
 // and then capturing and accessing its output before
 // it has completed using BytesSoFar() and GetComboOutSoFar().
 //
 type CaptureOuts struct {
-	lines    []string // segment by lines, so stdout and stderr don't mangle/cross talk.
-	isStdErr []bool
-	halfline [2]*string // halfline[0] for stdout, halfline[1] for stderr
-	mut      sync.Mutex
+	lines   []string    // segment by lines, so stdout and stderr don't mangle/cross talk.
+	streams []Stream    // the Stream each line came from.
+	times   []time.Time // capture time of each line, if timestamps.
+	mut     sync.Mutex
 
 	wg sync.WaitGroup
 
 	fromChildStdout io.ReadCloser
 	fromChildStderr io.ReadCloser
 
-	cmd  *exec.Cmd
-	Done chan struct{}
-	Err  error
+	delim byte // record delimiter; '\n' unless changed by SetDelimiter.
+
+	encoding encoding.Encoding // of the child's output; nil for UTF-8.
+
+	readerWrapper func(io.Reader) io.Reader // from SetReaderWrapper.
+
+	// from SetRequireUTF8, and the lines found invalid.
+	requireUTF8 bool
+	utf8Replace bool
+	invalidUTF8 int
+
+	sink     LineSink // also receives each line, if set.
+	sinkOnly bool     // don't keep c.lines when there is a sink.
+
+	// lineAdded is closed, and cleared, when the next line is
+	// stored; made on demand by readers waiting for more.
+	lineAdded chan struct{}
+
+	// subscribers, from Subscribe. Lines for them go, in
+	// order under teeMut, to bcast, whose broadcaster
+	// goroutine owns the subscribers and fans out to them.
+	bcast   chan bcastMsg // nil until the first Subscribe.
+	nsubs   int
+	maxSubs int // 0 for no limit.
+
+	framers        []*framer // from FrameChan.
+	framesClosed   bool
+	subsClosed     bool // capture is complete; no more subs.
+	bufferUntilSub bool
+	handedOff      bool // the first Subscribe has taken the lines.
+
+	timestamps bool
+	collapse   bool  // from SetCollapseRepeats.
+	counts     []int // times each line was seen in a row, with collapse.
+	pipeline   bool  // in ExecPipeline, so stages are recorded.
+	stages     []int // the pipeline stage of each line, if pipeline.
+
+	// offsets[i] is the byte offset of lines[i] in the
+	// combined output, counting from the first line ever
+	// stored; nextOffset is that of the next line.
+	offsets    []int64
+	nextOffset int64
+
+	trimNewline bool
+
+	stdin     io.Reader
+	stdinTee  bool
+	stdinFile *os.File // from SetStdinFile, closed by finish.
+
+	firstOutput chan struct{} // closed when sawOutput is set.
+	started     chan struct{} // closed when the process has started.
+	sawStart    bool
+	sawOutput   bool
+	sawStream   [numStreams]bool // whether a line has come from each.
+
+	skipBlank    bool
+	skippedBlank int
+
+	// from SetMaxLinesPerSecond: the budget, the start of the
+	// current second and the lines stored in it, and the
+	// lines dropped for want of budget.
+	maxLinesPerSec int
+	rateStart      time.Time
+	rateCount      int
+	rateDropped    int
+
+	assemblyTimeout time.Duration // from SetLineAssemblyTimeout.
+	forceFlushed    int           // lines it flushed early.
+
+	umask int // for the child; -1 to leave it alone.
+
+	onStderrLine func(line string)
+
+	// per stream EOF callbacks, from OnStdoutEOF and
+	// OnStderrEOF, and the readers of each stream still open.
+	onEOF    [numStreams]func()
+	eofOpen  [numStreams]int
+	eofFired [numStreams]bool
+
+	onRead func(stream Stream, n int) // from OnRead.
+
+	readDelay func() time.Duration // from setReadDelay, for tests.
+
+	bufSizes [numStreams]int // from SetBufSizes; 0 for the default.
+
+	storedBytes    int64 // total bytes ever stored in lines.
+	captureUntil   int64 // if > 0, stop storing once storedBytes reaches this.
+	captureStopped bool
+	stopAfterBlank bool // from SetStopAfterBlankLine.
+	killAfterBlank bool // from SetKillAfterBlankLine.
+
+	tailBytes    int   // if > 0, only the last tailBytes bytes are kept.
+	tailHeld     int64 // bytes currently in lines, in tail mode.
+	droppedLines int   // lines evicted from the front of lines.
+	lineSeq      int   // lines captured, each repeat counted; the next seq.
+	cutShort     bool  // stored output was cut or discarded; see Truncated.
+
+	retain time.Duration // if > 0, only lines this recent are kept.
+
+	idleAfter  time.Duration // from OnIdle.
+	onIdle     func()
+	lastLineAt time.Time // when the last line was stored, with OnIdle.
+
+	usePTY  bool
+	ptmx    *os.File // the PTY master, in PTY mode.
+	ptySize *pty.Winsize
+
+	slogger     *slog.Logger
+	slogLevel   slog.Level
+	slogCh      chan slogLine
+	slogDone    chan struct{}
+	slogDropped int64
+
+	// raw bytes read from each pipe, before line splitting.
+	stdoutBytesRead atomic.Int64
+	stderrBytesRead atomic.Int64
+
+	// the byte counts as of the last DeltaBytes call.
+	stdoutDeltaMark atomic.Int64
+	stderrDeltaMark atomic.Int64
+
+	// teeMut serializes writes to the tee writers, so they see
+	// lines in the same order as c.lines. To keep that order,
+	// addLine takes teeMut before releasing mut; so never take
+	// mut while holding teeMut.
+	teeMut           sync.Mutex
+	teeCombined      io.Writer
+	ndjson           io.Writer
+	teeErr           error // protected by teeMut.
+	teePolicy        TeeErrorPolicy
+	teeKilled        bool // protected by teeMut.
+	teeFlushInterval time.Duration
+	rotating         *rotatingFile // from SetRotatingFile; used under teeMut.
+	stdoutSink       io.Writer
+	stdoutSinkKeep   bool
+
+	builder *strings.Builder // from SetCombinedBuilder; written under mut.
+
+	classifier  func(line string) string // from SetLineClassifier.
+	classCounts map[string]int
+
+	callbackErr atomic.Pointer[error] // first panic recovered by safely.
+
+	cmdLine  string // for Describe and String.
+	pid      int
+	running  bool
+	exitCode int // -1 until the process has exited.
+
+	startTime time.Time // when the process started.
+	endTime   time.Time // when capture completed.
+
+	// execCommand makes the *exec.Cmd for every way of running
+	// a command. It is exec.CommandContext, except in tests,
+	// which can substitute a helper that runs the test binary
+	// itself (the TestHelperProcess pattern) to produce start
+	// failures or odd exit codes on demand.
+	execCommand func(ctx context.Context, name string, args ...string) *exec.Cmd
+
+	// killOnStderr is from SetKillOnStderr; stderrKillLine is
+	// the line that triggered the kill, once it has.
+	killOnStderr   bool
+	stderrKillLine *string
+
+	// readErr is the first error, other than io.EOF, from
+	// reading the output; see SetKillOnReadError.
+	readErr         error
+	killOnReadError bool
+
+	preStart   func(cmd *exec.Cmd) error
+	errWrapper func(stage string, err error) error
+	extraFiles []*os.File
+	newSession bool
+
+	passthrough   bool
+	passthroughTo io.Writer // nil for os.Stdout.
+
+	countOnlyStdout bool // from SetCountOnlyStdout.
+	cancelCh        <-chan struct{}
+
+	cmd   *exec.Cmd
+	procs []*exec.Cmd // the stages started, in ExecPipeline.
+	pipes []io.Closer // our ends of the pipes we capture from.
+	Done  chan struct{}
+	Err   error
 }
 
 func NewCaptureOuts() *CaptureOuts {
 	return &CaptureOuts{
-		Done: make(chan struct{}),
+		Done:     make(chan struct{}),
+		delim:    '\n',
+		exitCode: -1,
+		umask:    -1,
+
+		firstOutput: make(chan struct{}),
+		started:     make(chan struct{}),
+		execCommand: exec.CommandContext,
+	}
+}
+
+// SetEncoding tells us the text encoding of the child's
+// output, such as charmap.ISO8859_1 or unicode.UTF16(...)
+// from golang.org/x/text, so that we transform it to UTF-8
+// before splitting it into lines and storing it. Without
+// this, the raw bytes of, say, a Windows tool's UTF-16LE
+// output would be stored as garbled strings. The default,
+// nil, passes output through untouched, assuming UTF-8. The
+// delimiter (see SetDelimiter) applies to the decoded text.
+// BytesReadStdout and BytesReadStderr count the raw bytes,
+// before decoding. Call SetEncoding before Exec.
+func (c *CaptureOuts) SetEncoding(enc encoding.Encoding) {
+	c.mut.Lock()
+	c.encoding = enc
+	c.mut.Unlock()
+}
+
+// decoder returns a new decoder for the encoding given to
+// SetEncoding, or nil if there is none. Each stream needs
+// its own, since decoders are stateful.
+func (c *CaptureOuts) decoder() *encoding.Decoder {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.encoding == nil {
+		return nil
 	}
+	return c.encoding.NewDecoder()
+}
+
+// SetRequireUTF8 checks each captured line for invalid
+// UTF-8, for consumers, such as encoding/json, that need
+// valid text. With replace, each run of invalid bytes in a
+// line is replaced by U+FFFD before the line is stored (and
+// handed on to tee writers, subscribers and so on). Without
+// it, the line is kept as is, but flagged with Binary set in
+// the Lines returned by, e.g., CollapsedLines and Subscribe.
+// Either way, Stats().InvalidUTF8Lines counts such lines.
+// The check applies after any SetEncoding decoding. Call it
+// before Exec.
+func (c *CaptureOuts) SetRequireUTF8(replace bool) {
+	c.mut.Lock()
+	c.requireUTF8 = true
+	c.utf8Replace = replace
+	c.mut.Unlock()
+}
+
+// isBinary reports whether line is flagged as binary, under
+// SetRequireUTF8(false). The caller must hold c.mut.
+func (c *CaptureOuts) isBinary(line string) bool {
+	return c.requireUTF8 && !c.utf8Replace && !utf8.ValidString(line)
+}
+
+// SetReaderWrapper arranges for each of the child's output
+// streams to be read through fn(pipe), rather than directly,
+// for output that must be transformed before it is split
+// into lines: say fn returns a gzip.Reader for a child that
+// writes compressed output, or a decoder of some custom
+// framing. fn is called once per stream (just once in PTY
+// mode), on the goroutine that captures that stream, so it
+// may block reading from the pipe, as gzip.NewReader does
+// to read a header; but it must return a non-nil reader, and
+// the readers it returns must not be shared between streams.
+// A read error from the returned reader ends capture of that
+// stream, like one from the pipe itself; anything it leaves
+// unread in the pipe is drained and discarded. A panic in fn,
+// or in the reader, is recovered, reported by CallbackErr,
+// and ends capture of the stream with a read error. The wrapping
+// comes before SetEncoding's decoding. BytesReadStdout and
+// BytesReadStderr, and OnRead, count the bytes read from the
+// pipe; FrameChan sees the transformed bytes. nil, the
+// default, reads the pipes directly. Call it before Exec.
+func (c *CaptureOuts) SetReaderWrapper(fn func(io.Reader) io.Reader) {
+	c.mut.Lock()
+	c.readerWrapper = fn
+	c.mut.Unlock()
+}
+
+// SetDelimiter changes the byte that terminates each stored
+// line (record). The default is '\n'. For example, use 0 to
+// capture the NUL-separated output of `find -print0`. The
+// delimiter is kept at the end of each stored record, just
+// as '\n' is by default. Call SetDelimiter before Exec.
+func (c *CaptureOuts) SetDelimiter(delim byte) {
+	c.delim = delim
+}
+
+// OnStderrLine registers fn to be called with each completed
+// stderr line, just after it is stored; for example, to
+// page someone whenever the child writes to stderr. fn runs
+// on the stderr capture goroutine, so it sees lines in order,
+// and should return promptly: until it does, no further
+// stderr is read. fn may call the other CaptureOuts methods.
+// A later call replaces an earlier fn; nil removes it.
+func (c *CaptureOuts) OnStderrLine(fn func(line string)) {
+	c.mut.Lock()
+	c.onStderrLine = fn
+	c.mut.Unlock()
+}
+
+// defaultBufSize is the size of the buffer we read each
+// stream through, unless changed by SetBufSizes.
+const defaultBufSize = 8 << 20
+
+// SetBufSizes sets the sizes of the buffers through which we
+// read the child's stdout and stderr. Their volumes can
+// differ greatly, and reading a trickle of stderr through the
+// default 8 MiB buffer wastes memory; while lines longer than
+// the buffer cost extra copying. Zero, or less, keeps the
+// default of 8 MiB. In PTY mode, the stdout size is used.
+// Call SetBufSizes before Exec.
+func (c *CaptureOuts) SetBufSizes(stdout, stderr int) {
+	c.mut.Lock()
+	c.bufSizes[Stdout] = stdout
+	c.bufSizes[Stderr] = stderr
+	c.mut.Unlock()
+}
+
+// OnStdoutEOF registers fn to be called once the child's
+// stdout (in PTY mode, its merged output) reaches EOF, and
+// its final unterminated line, if any, has been stored; for
+// protocols where the closing of stdout marks the end of the
+// data. This can be well before the process exits, and is
+// always before cmd.Wait(). fn runs on the capture goroutine,
+// at most once. A later call replaces an earlier fn.
+func (c *CaptureOuts) OnStdoutEOF(fn func()) {
+	c.mut.Lock()
+	c.onEOF[Stdout] = fn
+	c.mut.Unlock()
+}
+
+// OnStderrEOF is like OnStdoutEOF, for stderr. In
+// ExecPipeline, it is called once the stderr of every
+// stage has reached EOF.
+func (c *CaptureOuts) OnStderrEOF(fn func()) {
+	c.mut.Lock()
+	c.onEOF[Stderr] = fn
+	c.mut.Unlock()
+}
+
+// OnRead registers fn to be called after each Read from the
+// process's stdout or stderr, with the stream and the number
+// of bytes just read, for a progress bar that advances
+// smoothly even while a long line is still incomplete. In
+// PTY mode the stream is Merged. fn runs on the capture
+// goroutine, without the lock held, once per Read (which
+// may be many times a second), so it should be quick: an
+// atomic add, say. Should fn panic, the panic is recovered
+// and reported by CallbackErr, and fn is not called again
+// for that stream. Call OnRead before Exec.
+func (c *CaptureOuts) OnRead(fn func(stream Stream, n int)) {
+	c.mut.Lock()
+	c.onRead = fn
+	c.mut.Unlock()
+}
+
+// readNotifier calls fn with the size of each non-empty
+// Read from r, which is stream a, until fn panics.
+type readNotifier struct {
+	r  io.Reader
+	a  Stream
+	fn func(stream Stream, n int)
+	c  *CaptureOuts
+}
+
+func (rn *readNotifier) Read(p []byte) (int, error) {
+	n, err := rn.r.Read(p)
+	if n > 0 && rn.fn != nil {
+		ok := false
+		rn.c.safely("OnRead callback", func() {
+			rn.fn(rn.a, n)
+			ok = true
+		})
+		if !ok {
+			rn.fn = nil
+		}
+	}
+	return n, err
+}
+
+// setReadDelay makes each Read from the child's output wait
+// fn() first, so that tests can simulate a slow or bursty
+// producer, deterministically, to exercise the polling and
+// subscription code. Call it before Exec. It is unexported,
+// for this package's tests only.
+func (c *CaptureOuts) setReadDelay(fn func() time.Duration) {
+	c.mut.Lock()
+	c.readDelay = fn
+	c.mut.Unlock()
+}
+
+// safeReader reads from r, the reader from SetReaderWrapper,
+// recovering from any panic in its Read, which then fails.
+type safeReader struct {
+	r io.Reader
+	c *CaptureOuts
+}
+
+func (sr *safeReader) Read(p []byte) (n int, err error) {
+	err = errors.New("the reader from SetReaderWrapper panicked")
+	sr.c.safely("SetReaderWrapper reader", func() { n, err = sr.r.Read(p) })
+	return n, err
+}
+
+// slowReader waits delay() before each Read from r.
+type slowReader struct {
+	r     io.Reader
+	delay func() time.Duration
+}
+
+func (sr *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(sr.delay())
+	return sr.r.Read(p)
+}
+
+// streamEOF notes that a reader of stream a is done, and
+// fires the EOF callback once the last of them is.
+func (c *CaptureOuts) streamEOF(a Stream) {
+	if a == Merged {
+		a = Stdout
+	}
+	c.mut.Lock()
+	c.eofOpen[a]--
+	if c.eofOpen[a] > 0 || c.eofFired[a] || c.onEOF[a] == nil {
+		c.mut.Unlock()
+		return
+	}
+	c.eofFired[a] = true
+	fn := c.onEOF[a]
+	c.mut.Unlock()
+	c.safely(a.String()+" EOF callback", fn)
+}
+
+// SetCaptureUntilBytes arranges for only the first n bytes
+// of combined output to be stored; for peeking at a process's
+// startup logs, say, and then no longer caring. The line that
+// crosses the n byte mark is truncated so that exactly n
+// bytes are kept. From then on the capture goroutines simply
+// drain and discard the child's output, so the child never
+// blocks on a full pipe, and CaptureStopped() reports true.
+// The process itself keeps running. n <= 0 means no limit,
+// which is the default. Call SetCaptureUntilBytes before Exec.
+func (c *CaptureOuts) SetCaptureUntilBytes(n int64) {
+	c.mut.Lock()
+	c.captureUntil = n
+	c.mut.Unlock()
+}
+
+// SetCombinedMaxBytes caps the total bytes stored, across
+// stdout and stderr together, at n, whichever stream they
+// come from; a single memory budget per capture, for services
+// running many of them. It is another name for
+// SetCaptureUntilBytes(n): the line crossing the cap is cut
+// short, later output is drained and discarded so the child
+// never blocks, and Truncated() then reports true.
+func (c *CaptureOuts) SetCombinedMaxBytes(n int64) {
+	c.SetCaptureUntilBytes(n)
+}
+
+// SetStopAfterBlankLine(true) stops storing output at the
+// first blank line (empty, or only white space) from stdout,
+// for tools that print a header block, HTTP or email style,
+// ended by a blank line, followed by a body we don't need.
+// The header lines, those before the blank line (which is not
+// stored itself), are then what GetStdoutSoFar returns. As
+// with SetCaptureUntilBytes, later output, from either
+// stream, is drained and discarded, CaptureStopped() reports
+// true, and the process keeps running; see
+// SetKillAfterBlankLine to end it there. Call it before Exec.
+func (c *CaptureOuts) SetStopAfterBlankLine(on bool) {
+	c.mut.Lock()
+	c.stopAfterBlank = on
+	c.mut.Unlock()
+}
+
+// SetKillAfterBlankLine(true) is SetStopAfterBlankLine(true),
+// and also kills the process (every stage, in ExecPipeline)
+// at the blank line, as SetKillOnStderr does, for a tool
+// whose body we'd rather it not bother to produce. c.Err
+// then reports the kill, as ErrWaitFailed. Call it before
+// Exec.
+func (c *CaptureOuts) SetKillAfterBlankLine(on bool) {
+	c.mut.Lock()
+	c.killAfterBlank = on
+	c.mut.Unlock()
+}
+
+// CaptureStopped returns true once the byte limit set by
+// SetCaptureUntilBytes has been reached, or the blank line
+// of SetStopAfterBlankLine seen, and further output is
+// being discarded.
+func (c *CaptureOuts) CaptureStopped() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.captureStopped
+}
+
+// FirstOutput returns a channel that is closed as soon as the
+// first line, from either stream, has been stored. This is a
+// lightweight readiness signal, for when any output at all
+// means the process is up. It is closed exactly once, and
+// stays closed even if ExecRetry later discards that output.
+func (c *CaptureOuts) FirstOutput() <-chan struct{} {
+	return c.firstOutput
+}
+
+// HasStdout returns true once at least one line from the
+// child's stdout (or, in PTY mode, its merged output) has
+// been captured; a cheap check for "has it started writing
+// results", which stays true even if the line is later
+// evicted. See also FirstOutput.
+func (c *CaptureOuts) HasStdout() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.sawStream[Stdout] || c.sawStream[Merged]
+}
+
+// HasStderr is the stderr counterpart of HasStdout: has the
+// child logged any errors yet?
+func (c *CaptureOuts) HasStderr() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.sawStream[Stderr]
+}
+
+// SetCancelChan arranges for the process to be killed if ch
+// is closed before it completes, for codebases that signal
+// cancellation with a plain done channel rather than a
+// context. It is treated just like the cancellation of the
+// context given to ExecContext: output captured beforehand
+// is kept, and c.Err wraps context.Canceled. It applies to
+// every Exec method, including ExecPipeline, where every
+// stage is killed. Call it before Exec.
+func (c *CaptureOuts) SetCancelChan(ch <-chan struct{}) {
+	c.mut.Lock()
+	c.cancelCh = ch
+	c.mut.Unlock()
+}
+
+// withCancelChan returns a context derived from ctx that is
+// cancelled, and the process killed, if the SetCancelChan
+// channel is closed. Call stop once the process is done.
+func (c *CaptureOuts) withCancelChan(ctx context.Context) (_ context.Context, stop func()) {
+	c.mut.Lock()
+	ch := c.cancelCh
+	c.mut.Unlock()
+	if ch == nil {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+			c.killProcs()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// SetErrorWrapper lets the caller decide what error Exec and
+// friends return, and store in c.Err, in place of our own
+// rather verbose ones; to add the command name, say, or to
+// use their own error types. When something fails, fn is
+// called with the step that failed and the underlying error:
+//
+//	"start"    cmd.Start() (or the pre-start hook) failed
+//	"wait"     cmd.Wait() failed; this includes a non-zero exit
+//	"read"     reading the output failed; see ErrReadFailed
+//	"context"  the context was done, or SetCancelChan fired
+//	"stderr"   SetKillOnStderr killed the process
+//	"pipeline" one or more ExecPipeline stages failed, joined
+//
+// and whatever it returns is used instead. nil, the default,
+// keeps our own errors. Call it before Exec.
+func (c *CaptureOuts) SetErrorWrapper(fn func(stage string, err error) error) {
+	c.mut.Lock()
+	c.errWrapper = fn
+	c.mut.Unlock()
+}
+
+// stageErr is the error for a step of running a command that
+// failed: the step, as named for SetErrorWrapper, the
+// underlying error, and our own error for it. We decide what
+// to do next, as whether to retry, from the step; only
+// publicErr, as the error is returned, applies the wrapper.
+type stageErr struct {
+	stage string
+	err   error
+	ours  error
+}
+
+func (e *stageErr) Error() string { return e.ours.Error() }
+func (e *stageErr) Unwrap() error { return e.ours }
+
+// stageError returns a *stageErr for err, from the given
+// step, with ours as our own error for it.
+func stageError(stage string, err, ours error) error {
+	return &stageErr{stage: stage, err: err, ours: ours}
+}
+
+// failedStage returns the step that err, from runOnce or the
+// like, failed at; "" if none.
+func failedStage(err error) string {
+	var se *stageErr
+	if errors.As(err, &se) {
+		return se.stage
+	}
+	return ""
+}
+
+// publicErr returns err as Exec and friends return it: the
+// SetErrorWrapper's version of a *stageErr, if there is a
+// wrapper, or else our own error.
+func (c *CaptureOuts) publicErr(err error) error {
+	se, ok := err.(*stageErr)
+	if !ok {
+		return err
+	}
+	c.mut.Lock()
+	fn := c.errWrapper
+	c.mut.Unlock()
+	if fn == nil {
+		return se.ours
+	}
+	return fn(se.stage, se.err)
+}
+
+// SetExtraFiles passes files on to the child as open file
+// descriptors, beyond stdin, stdout and stderr, via
+// cmd.ExtraFiles: files[0] becomes the child's fd 3, files[1]
+// fd 4, and so on. This is for programs that expect a pipe or
+// socket on a higher fd, as with systemd socket activation,
+// while their stdout and stderr are captured as usual. A nil
+// entry leaves that fd closed in the child. We don't close
+// the files; the caller should, once the child has started.
+// Not applied by ExecPipeline. Call it before Exec.
+func (c *CaptureOuts) SetExtraFiles(files []*os.File) {
+	c.mut.Lock()
+	c.extraFiles = files
+	c.mut.Unlock()
+}
+
+// SetPreStart arranges for fn to be called with the
+// *exec.Cmd just before Exec (and ExecContext, ExecRetry
+// and so on) starts it, after all our other configuration,
+// such as SetStdin and SetNewSession, has been applied; a place
+// for last minute logging, or for setting fields of the Cmd,
+// like ExtraFiles or SysProcAttr, that have no setter of
+// their own. fn should leave Stdout and Stderr alone, and in
+// PTY mode, SysProcAttr too. If fn returns an error, the
+// process is not started, and c.Err wraps ErrStartFailed
+// and the error. fn is not called by ExecPipeline.
+func (c *CaptureOuts) SetPreStart(fn func(cmd *exec.Cmd) error) {
+	c.mut.Lock()
+	c.preStart = fn
+	c.mut.Unlock()
+}
+
+// DoneChan returns c.Done, for callers that want to select
+// on it alongside their own channels without depending on
+// the field. As with c.Done, it is closed exactly once, after
+// all the output has been stored and c.Err has been set.
+func (c *CaptureOuts) DoneChan() <-chan struct{} {
+	return c.Done
+}
+
+// Started returns a channel that is closed as soon as the
+// process has been started, so that a caller running Exec on
+// another goroutine can then use PID or Signal without racing
+// the start. If the process cannot be started, it is never
+// closed; c.Done is closed, with the error in c.Err, instead.
+// With ExecRetry it is closed by the first successful start,
+// and with ExecPipeline once every stage has started.
+func (c *CaptureOuts) Started() <-chan struct{} {
+	return c.started
+}
+
+// markStarted closes c.started, once. The caller must
+// hold c.mut.
+func (c *CaptureOuts) markStarted() {
+	if !c.sawStart {
+		c.sawStart = true
+		close(c.started)
+	}
+}
+
+// PID returns the process id of the child, or 0 if it
+// has not been started. In ExecPipeline, it is that of
+// the last command.
+func (c *CaptureOuts) PID() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.pid
+}
+
+// Signal sends sig to the child, which must be running.
+func (c *CaptureOuts) Signal(sig os.Signal) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if !c.running || c.cmd == nil || c.cmd.Process == nil {
+		return fmt.Errorf("error in CaptureOuts.Signal(): process is not running")
+	}
+	return c.cmd.Process.Signal(sig)
+}
+
+// SetExpectedLines pre-allocates room for n lines, when the
+// approximate amount of output is known in advance, so that
+// storing a large capture doesn't repeatedly grow (and copy)
+// the line slices. It is only a performance hint: more or
+// fewer lines work just the same. Call it before Exec.
+func (c *CaptureOuts) SetExpectedLines(n int) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if n <= len(c.lines) {
+		return
+	}
+	c.lines = slices.Grow(c.lines, n-len(c.lines))
+	c.streams = slices.Grow(c.streams, n-len(c.streams))
+	c.offsets = slices.Grow(c.offsets, n-len(c.offsets))
+	if c.timestamps {
+		c.times = slices.Grow(c.times, n-len(c.times))
+	}
+}
+
+// SetMaxLinesPerSecond caps the lines stored at n in any
+// one second, to protect against a child flooding us with
+// logs. Once n lines have been stored in the current second,
+// the rest are read but dropped, like skipped blank lines,
+// not stored nor passed to callbacks or tees, until the next
+// second begins; Stats() reports how many were dropped.
+// Unlike a limit on the read rate, this never slows the
+// child down. Each second starts with the first line after
+// the last one has ended. n <= 0, the default, means no
+// limit. Call it before Exec.
+func (c *CaptureOuts) SetMaxLinesPerSecond(n int) {
+	c.mut.Lock()
+	c.maxLinesPerSec = n
+	c.mut.Unlock()
+}
+
+// SetSkipBlankLines(true) arranges for lines that are empty or
+// all whitespace, apart from their delimiter, to be read but
+// not stored, nor passed to callbacks or tees. This declutters
+// the capture of tools that emit many blank separator lines.
+// The number skipped is reported by Stats(). Call
+// SetSkipBlankLines before Exec.
+func (c *CaptureOuts) SetSkipBlankLines(skip bool) {
+	c.mut.Lock()
+	c.skipBlank = skip
+	c.mut.Unlock()
+}
+
+// BytesReadStdout returns the number of bytes read so far
+// from the child's stdout. It is updated live, as each read
+// completes, so unlike the stored lines it includes any
+// partial line not yet terminated by the delimiter, as well
+// as any bytes drained after SetCaptureUntilBytes stopped
+// storing output.
+func (c *CaptureOuts) BytesReadStdout() int64 {
+	return c.stdoutBytesRead.Load()
+}
+
+// BytesReadStderr is the stderr counterpart of BytesReadStdout.
+func (c *CaptureOuts) BytesReadStderr() int64 {
+	return c.stderrBytesRead.Load()
+}
+
+// DeltaBytes returns the number of bytes read from the
+// child's stdout and stderr, counted as by BytesReadStdout
+// and BytesReadStderr, since the previous call to DeltaBytes
+// (or, on the first call, since the start); for a throughput
+// meter that calls it once a second to show each stream's
+// rate. Concurrent callers each get their own share of the
+// bytes: none is counted twice.
+func (c *CaptureOuts) DeltaBytes() (stdout, stderr int64) {
+	return delta(&c.stdoutBytesRead, &c.stdoutDeltaMark), delta(&c.stderrBytesRead, &c.stderrDeltaMark)
+}
+
+// delta advances mark to the current count n, returning by
+// how much it moved.
+func delta(n, mark *atomic.Int64) int64 {
+	for {
+		was := mark.Load()
+		now := n.Load()
+		if mark.CompareAndSwap(was, now) {
+			return now - was
+		}
+	}
+}
+
+// countingReader adds the number of bytes
+// read from r to n, atomically.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// CaptureSnapshot is a consistent view of a CaptureOuts,
+// as returned by Snapshot().
+type CaptureSnapshot struct {
+	// Lines and IsStdErr are as returned by
+	// GetComboOutSoFar(true): the lines captured so far, and
+	// whether each came from stderr. Valid at any time.
+	Lines    []string
+	IsStdErr []bool
+
+	// LineCount is len(Lines).
+	LineCount int
+
+	// Running is true from the moment the process has
+	// started until Exec has collected its exit status.
+	Running bool
+
+	// ExitCode is the process's exit code, only valid after
+	// completion. It is -1 before then, and also if the
+	// process never started, or was terminated by a signal.
+	ExitCode int
+
+	// Err is c.Err, only valid after completion; it is
+	// always nil before then.
+	Err error
+}
+
+// Snapshot returns a CaptureSnapshot computed atomically under
+// the lock, so that a UI sees all the fields in the same
+// state, rather than calling several accessors that could
+// each observe a different moment of an ongoing capture.
+func (c *CaptureOuts) Snapshot() CaptureSnapshot {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	s := CaptureSnapshot{
+		Lines:    make([]string, 0, len(c.lines)),
+		IsStdErr: make([]bool, 0, len(c.lines)),
+		Running:  c.running,
+		ExitCode: c.exitCode,
+		Err:      c.Err,
+	}
+	for i, line := range c.lines {
+		for k := c.repeats(i); k > 0; k-- {
+			s.Lines = append(s.Lines, line)
+			s.IsStdErr = append(s.IsStdErr, c.streams[i] == Stderr)
+		}
+	}
+	s.LineCount = len(s.Lines)
+	return s
 }
 
 // GetComboOutSoFar can be called by any goroutine at any point to
@@ -51,27 +943,240 @@ func NewCaptureOuts() *CaptureOuts {
 func (c *CaptureOuts) GetComboOutSoFar(getIsStdErrorSlice bool) (res []string, isStdErr []bool) {
 	c.mut.Lock()
 	//vv("top of GetComboOutSoFar, c.lines='%#v'", c.lines)
+	if len(c.counts) > 0 {
+		// expand the repeats collapsed by SetCollapseRepeats.
+		for i, line := range c.lines {
+			for k := 0; k < c.counts[i]; k++ {
+				res = append(res, line)
+				if getIsStdErrorSlice {
+					isStdErr = append(isStdErr, c.streams[i] == Stderr)
+				}
+			}
+		}
+		c.mut.Unlock()
+		return
+	}
 	res = make([]string, len(c.lines))
 	copy(res, c.lines)
 	if getIsStdErrorSlice {
-		isStdErr = make([]bool, len(c.isStdErr))
-		copy(isStdErr, c.isStdErr)
+		isStdErr = c.isStdErr()
 	}
 	c.mut.Unlock()
 	return
 }
 
+// GetComboOutLimited is like GetComboOutSoFar(false), but
+// returns only the most recent whole lines that together
+// total at most maxBytes, for rendering into a small panel;
+// truncatedFront reports that earlier lines were left out:
+// stored lines, by this limit, or lines already evicted, as
+// by SetTailBytes. Lines never stored, as those only sent to
+// SetStdoutSink, don't count. It limits what is returned,
+// not what is stored.
+func (c *CaptureOuts) GetComboOutLimited(maxBytes int) (res []string, truncatedFront bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	total := 0
+	for i := len(c.lines) - 1; i >= 0; i-- {
+		for k := c.repeats(i); k > 0; k-- {
+			if total+len(c.lines[i]) > maxBytes {
+				slices.Reverse(res)
+				return res, true
+			}
+			total += len(c.lines[i])
+			res = append(res, c.lines[i])
+		}
+	}
+	slices.Reverse(res)
+	// nothing left out here; but had any been evicted?
+	return res, c.droppedLines > 0
+}
+
 // BytesSoFar returns both stdout and stderr up
 // until this point. Calling again will always return the
 // same plus possible additional, newly added, output.
+//
+// With SetTailBytes(n), at most the last n bytes are returned.
+// With SetTrimNewline(true), the delimiter is re-inserted
+// after every line.
 func (c *CaptureOuts) BytesSoFar() []byte {
 	var b bytes.Buffer
-	for _, v := range c.lines {
-		b.WriteString(v)
+	c.mut.Lock()
+	end := c.lineEnd()
+	for i, v := range c.lines {
+		for k := c.repeats(i); k > 0; k-- {
+			b.WriteString(v)
+			b.WriteString(end)
+		}
 	}
+	c.mut.Unlock()
 	return b.Bytes()
 }
 
+// SetTrimNewline(true) arranges for each line to be stored
+// without its trailing delimiter: without the "\n", or the
+// "\r\n", by default. This saves callers that don't want
+// them from stripping them everywhere.
+//
+// The tradeoff is that the stored lines no longer reproduce
+// the exact stream. So, in this mode, BytesSoFar, Output,
+// the tee writer and the file dumps re-insert the delimiter
+// after each line; but a "\r\n" comes back as just "\n", and
+// a final unterminated line gains a delimiter. The default is
+// to store lines exactly as read. Call SetTrimNewline before
+// Exec.
+func (c *CaptureOuts) SetTrimNewline(trim bool) {
+	c.mut.Lock()
+	c.trimNewline = trim
+	c.mut.Unlock()
+}
+
+// lineEnd returns what must follow each stored line to
+// reproduce the stream. The caller must hold c.mut.
+func (c *CaptureOuts) lineEnd() string {
+	if c.trimNewline {
+		return string(c.delim)
+	}
+	return ""
+}
+
+// SetTailBytes arranges for only the most recent n bytes of
+// combined output to be retained, with older output discarded
+// as new output arrives; for attaching the last 64 KiB of a
+// process's output to a crash report, say, without unbounded
+// memory use. Retention is byte granular: whole lines are
+// evicted from the front, and then the oldest remaining line
+// is cut short, so that BytesSoFar returns exactly the last
+// n bytes (or fewer, if that is all there has been). The
+// accessors returning lines see only the retained lines,
+// with the first possibly partial. One exception: a run of
+// repeats collapsed by SetCollapseRepeats is evicted a whole
+// line at a time, never cut, so then up to a line less than
+// n bytes may be kept. n <= 0 means retain everything, the
+// default. Call SetTailBytes before Exec.
+func (c *CaptureOuts) SetTailBytes(n int) {
+	c.mut.Lock()
+	c.tailBytes = n
+	c.mut.Unlock()
+}
+
+// trimToTail evicts the oldest output until at most
+// c.tailBytes bytes remain. The caller must hold c.mut.
+func (c *CaptureOuts) trimToTail() {
+	excess := c.tailHeld - int64(c.tailBytes)
+	for excess > 0 {
+		// with SetTrimNewline, the delimiter, put back by
+		// BytesSoFar, counts too.
+		n := int64(len(c.lines[0]) + len(c.lineEnd()))
+		if c.repeats(0) > 1 {
+			// the repeats of a collapsed run are all the one
+			// string, so can't be cut apart: drop one whole.
+			c.counts[0]--
+			c.offsets[0] += n
+			c.tailHeld -= n
+			c.cutShort = true
+			excess -= n
+			continue
+		}
+		if n > excess {
+			// copy, so the evicted prefix can be garbage collected.
+			c.lines[0] = strings.Clone(c.lines[0][excess:])
+			c.offsets[0] += excess
+			c.tailHeld -= excess
+			c.cutShort = true
+			return
+		}
+		c.evictOldest()
+		excess -= n
+	}
+}
+
+// evictOldest discards the oldest stored line. The caller
+// must hold c.mut.
+func (c *CaptureOuts) evictOldest() {
+	if c.tailBytes > 0 {
+		c.tailHeld -= int64(len(c.lines[0])+len(c.lineEnd())) * int64(c.repeats(0))
+	}
+	c.lines = c.lines[1:]
+	c.streams = c.streams[1:]
+	c.offsets = c.offsets[1:]
+	if len(c.times) > 0 {
+		c.times = c.times[1:]
+	}
+	if len(c.stages) > 0 {
+		c.stages = c.stages[1:]
+	}
+	if len(c.counts) > 0 {
+		c.counts = c.counts[1:]
+	}
+	c.droppedLines++
+	c.cutShort = true
+}
+
+// Output waits for the process to finish, and then returns
+// all of its stdout, with a single trailing newline trimmed
+// (like backticks in the shell), along with c.Err. It is the
+// counterpart of exec.Cmd.Output(), for a process started by
+// Exec on another goroutine. The stderr lines remain
+// available from GetComboOutSoFar.
+func (c *CaptureOuts) Output() (string, error) {
+	<-c.Done
+	var b strings.Builder
+	c.mut.Lock()
+	end := c.lineEnd()
+	for i, v := range c.lines {
+		if !c.streams[i].isStdout() {
+			continue
+		}
+		for k := c.repeats(i); k > 0; k-- {
+			b.WriteString(v)
+			b.WriteString(end)
+		}
+	}
+	err := c.Err
+	c.mut.Unlock()
+	return strings.TrimSuffix(b.String(), "\n"), err
+}
+
+// StderrEmpty returns true if no stderr lines have been
+// captured so far. After c.Done is closed, this is final,
+// so "c.Err == nil && c.StderrEmpty()" is the common
+// "exit 0 and nothing on stderr" success check.
+func (c *CaptureOuts) StderrEmpty() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, s := range c.streams {
+		if s == Stderr {
+			return false
+		}
+	}
+	return true
+}
+
+// Succeeded returns true if the process has finished, and
+// did so cleanly: c.Err is nil, so it exited 0 (and, say,
+// was not stopped by SetKillOnStderr). Before then, it
+// returns false. Unlike StderrEmpty, it doesn't care what
+// was written to stderr.
+func (c *CaptureOuts) Succeeded() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.isDone() && c.Err == nil
+}
+
+// Validate checks that arg0 can be found via exec.LookPath
+// and is executable, without starting anything. This lets
+// callers fail fast with a friendly message, before handing
+// arg0 to Exec on another goroutine. Validate does not
+// modify c.Err or touch c.Done.
+func (c *CaptureOuts) Validate(arg0 string) error {
+	_, err := exec.LookPath(arg0)
+	if err != nil {
+		return fmt.Errorf("error in CaptureOuts.Validate(): cannot run '%s': '%v'", arg0, err)
+	}
+	return nil
+}
+
 // Exec runs the specified arg0 process path with
 // args as inputs, and blocks until the child
 // process is complete. It should typically be
@@ -81,85 +1186,692 @@ func (c *CaptureOuts) BytesSoFar() []byte {
 // is finished, it will set c.Err and then close
 // the c.Done channel.
 func (c *CaptureOuts) Exec(arg0 string, args ...string) error {
-	cmd := exec.Command(arg0, args...)
-	defer close(c.Done)
-	c.cmd = cmd
+	return c.run(context.Background(), "Exec", c.execCommand(context.Background(), arg0, args...))
+}
 
-	fromChildStdout, _ := cmd.StdoutPipe()
-	fromChildStderr, _ := cmd.StderrPipe()
+// ExecContext is like Exec, but the child is killed if ctx
+// is cancelled, or its deadline passes, before it completes.
+// Cancellation doesn't discard what was already captured:
+// when ExecContext returns, even with a context error, c.Done
+// is closed, and GetComboOutSoFar returns every line captured
+// before the kill, plus any the child's pipes still held. The
+// error then wraps ctx.Err(), so errors.Is(err,
+// context.Canceled) or context.DeadlineExceeded can tell a
+// cancellation from a failure of the command itself. See
+// ExecContextGrace to give the child a chance to exit first.
+// Only the child is killed; should it have started processes
+// of its own that hold its stdout or stderr open, as "sh -c"
+// does, we stop reading about half a second after the kill
+// rather than wait for them to close the pipes, so that
+// ExecContext returns promptly. Anything they write after
+// that is lost. The same goes for the other ways a process
+// is killed, such as SetKillOnStderr and SetCancelChan.
+func (c *CaptureOuts) ExecContext(ctx context.Context, arg0 string, args ...string) error {
+	return c.run(ctx, "ExecContext", c.execCommand(ctx, arg0, args...))
+}
+
+// ExecContextGrace is like Exec, but when ctx is cancelled
+// (or its deadline passes) the child is first sent SIGTERM,
+// giving it the chance to clean up and exit on its own. Only
+// if it is still running grace later is it sent SIGKILL.
+// This differs from exec.CommandContext, which sends SIGKILL
+// straight away. On Windows, where SIGTERM cannot be
+// delivered, the child is killed once grace has elapsed.
+//
+// Output captured before and after the SIGTERM is retained.
+// If ctx was done, c.Err reports ctx.Err() alongside the
+// result of cmd.Wait(). grace <= 0 means no grace at all:
+// the child is sent SIGKILL straight away, as by ExecContext.
+func (c *CaptureOuts) ExecContextGrace(ctx context.Context, grace time.Duration, arg0 string, args ...string) error {
+	cmd := c.execCommand(ctx, arg0, args...)
+	if grace > 0 {
+		// without a WaitDelay, os/exec would never follow the
+		// SIGTERM with a SIGKILL.
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(syscall.SIGTERM)
+		}
+		cmd.WaitDelay = grace
+	}
+	return c.run(ctx, "ExecContextGrace", cmd)
+}
+
+// ExecRetry is like Exec, but if the command fails (exits
+// non-zero, or cannot be started) it is run again, up to a
+// total of attempts times, sleeping backoff before the first
+// retry and doubling the sleep before each later one.
+// Before each retry the output captured so far is discarded,
+// so that finally the captured output is that of the last
+// attempt, and c.Err is nil on eventual success, or else
+// reflects the last failure. c.Done is only closed once,
+// after the last attempt.
+func (c *CaptureOuts) ExecRetry(attempts int, backoff time.Duration, arg0 string, args ...string) error {
+	var err error
+	for i := 0; i == 0 || i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			c.resetOutput()
+		}
+		err = c.runOnce(context.Background(), "ExecRetry", c.execCommand(context.Background(), arg0, args...))
+		if err == nil || failedStage(err) == "context" {
+			// succeeded, or SetCancelChan's channel was closed.
+			break
+		}
+	}
+	return c.finish(err)
+}
 
-	c.capture(fromChildStdout, true)
-	c.capture(fromChildStderr, false)
+// run starts cmd with its stdout and stderr captured,
+// and blocks until it completes. It sets c.Err and then
+// closes c.Done, via c.finish(). The name of the calling
+// method is used in error messages.
+func (c *CaptureOuts) run(ctx context.Context, name string, cmd *exec.Cmd) error {
+	return c.finish(c.runOnce(ctx, name, cmd))
+}
+
+// runOnce does the work of run, without calling c.finish(),
+// so that it can be repeated by ExecRetry.
+func (c *CaptureOuts) runOnce(ctx context.Context, name string, cmd *exec.Cmd) error {
+	c.mut.Lock()
+	c.cmd = cmd
+	c.cmdLine = strings.Join(cmd.Args, " ")
+	c.pid = 0
+	c.mut.Unlock()
+	c.startSlogger(filepath.Base(cmd.Path))
+	defer c.stopSlogger()
+	stopFlusher := c.startTeeFlusher()
+	defer stopFlusher()
+	stopPruner := c.startRetainPruner()
+	defer stopPruner()
+	stopIdle := c.startIdleWatch()
+	defer stopIdle()
 
-	err := cmd.Start()
+	stdinDone := c.setupStdin(cmd)
+	err := c.applySession(cmd)
+	if err == nil {
+		err = c.start(cmd)
+	}
 	if err != nil {
-		c.Err = fmt.Errorf("error in CaptureOuts.Exec(): cmd.Start() failed with '%s'", err)
-		return c.Err
+		stdinDone()
+		return stageError("start", err, fmt.Errorf("error in CaptureOuts.%v(): %w with '%w'", name, ErrStartFailed, err))
 	}
+	c.mut.Lock()
+	c.running = true
+	c.pid = cmd.Process.Pid
+	c.startTime = time.Now()
+	c.markStarted()
+	c.mut.Unlock()
+	ctx, stopCancel := c.withCancelChan(ctx)
+	defer stopCancel()
+	read := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the child is being killed; allowing for the
+			// SIGTERM of ExecContextGrace.
+			c.closePipesLater(cmd.WaitDelay + drainAfterKill)
+		case <-read:
+		}
+	}()
 
 	// cmd.Wait() should be called only after we finish reading
 	// from fromChildStdout and fromChildStderr.
 	c.wg.Wait()
+	close(read)
+	c.stopSlogger()
+	c.mut.Lock()
+	if c.ptmx != nil {
+		c.ptmx.Close()
+		c.ptmx = nil
+	}
+	c.mut.Unlock()
 
 	err = cmd.Wait()
+	stdinDone()
+	c.mut.Lock()
+	c.running = false
+	c.mut.Unlock()
+	if serr := c.stderrKillErr(); serr != nil {
+		return stageError("stderr", serr, fmt.Errorf("error in CaptureOuts.%v(): %w; cmd.Wait() gave err='%v'", name, serr, err))
+	}
+	if ctx.Err() != nil {
+		return stageError("context", ctx.Err(), fmt.Errorf("error in CaptureOuts.%v(): context done with '%w'; cmd.Wait() gave err='%v'", name, ctx.Err(), err))
+	}
+	readErr := c.readError()
+	switch {
+	case err != nil && readErr != nil:
+		return stageError("wait", errors.Join(err, readErr), fmt.Errorf("error in CaptureOuts.%v(): %w with err='%w'; also %w with '%w'", name, ErrWaitFailed, err, ErrReadFailed, readErr))
+	case err != nil:
+		return stageError("wait", err, fmt.Errorf("error in CaptureOuts.%v(): %w with err='%w'", name, ErrWaitFailed, err))
+	case readErr != nil:
+		return stageError("read", readErr, fmt.Errorf("error in CaptureOuts.%v(): %w with '%w'", name, ErrReadFailed, readErr))
+	}
+	return nil
+}
+
+// CaptureReaders captures lines from the given stdout and
+// stderr readers, exactly as Exec does from a child's pipes,
+// and blocks until both readers are exhausted (return io.EOF
+// or any other error). Then it closes c.Done. Either reader
+// may be nil. This allows capturing from sources other than a
+// child process, such as the two ends of an existing pipeline,
+// and makes the line reassembly logic easy to exercise
+// without spawning anything.
+func (c *CaptureOuts) CaptureReaders(stdout, stderr io.Reader) error {
+	if stdout != nil {
+		c.capture(stdout, Stdout)
+	}
+	if stderr != nil {
+		c.capture(stderr, Stderr)
+	}
+	c.wg.Wait()
+	if readErr := c.readError(); readErr != nil {
+		return c.finish(stageError("read", readErr, fmt.Errorf("error in CaptureOuts.CaptureReaders(): %w with '%w'", ErrReadFailed, readErr)))
+	}
+	return c.finish(nil)
+}
+
+// start starts cmd, and begins capturing its output.
+func (c *CaptureOuts) start(cmd *exec.Cmd) error {
+	c.mut.Lock()
+	preStart := c.preStart
+	if c.extraFiles != nil {
+		cmd.ExtraFiles = c.extraFiles
+	}
+	c.mut.Unlock()
+	if preStart != nil {
+		if err := preStart(cmd); err != nil {
+			return fmt.Errorf("pre-start hook: %w", err)
+		}
+	}
+	if c.usePTY {
+		return c.startPTY(cmd)
+	}
+	var fromChildStdout io.Reader
+	if w := c.passthroughWriter(); w != nil {
+		cmd.Stdout = w
+	} else {
+		fromChildStdout, _ = cmd.StdoutPipe()
+	}
+	fromChildStderr, _ := cmd.StderrPipe()
+	c.setPipes(fromChildStdout, fromChildStderr)
+
+	err := c.withUmask(cmd.Start)
 	if err != nil {
-		c.Err = fmt.Errorf("error in CaptureOuts.Exec(): cmd.Wait() failed with err='%v'", err)
-		return c.Err
+		return err
 	}
+	if fromChildStdout != nil {
+		c.capture(fromChildStdout, Stdout)
+	}
+	c.capture(fromChildStderr, Stderr)
 	return nil
 }
 
-func (c *CaptureOuts) capture(r io.Reader, isStdout bool) {
-	a := 1 // for stderr
-	if isStdout {
-		a = 0
+// isStdErr returns a []bool with an entry for each stored
+// line, true if it came from stderr. The caller must hold c.mut.
+func (c *CaptureOuts) isStdErr() []bool {
+	res := make([]bool, len(c.streams))
+	for i, s := range c.streams {
+		res[i] = s == Stderr
 	}
-	c.wg.Add(1)
-	bufreader := bufio.NewReaderSize(r, 1024*1024*8)
+	return res
+}
+
+// linesSoFar returns copies of the stored lines, and
+// of the Stream each came from.
+func (c *CaptureOuts) linesSoFar() (lines []string, streams []Stream) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if len(c.counts) > 0 {
+		for i, line := range c.lines {
+			for k := 0; k < c.counts[i]; k++ {
+				lines = append(lines, line)
+				streams = append(streams, c.streams[i])
+			}
+		}
+		return
+	}
+	lines = make([]string, len(c.lines))
+	copy(lines, c.lines)
+	streams = make([]Stream, len(c.streams))
+	copy(streams, c.streams)
+	return
+}
+
+// repeats returns how many times the i-th stored line was
+// captured in a row; more than 1 only with SetCollapseRepeats.
+// The caller must hold c.mut.
+func (c *CaptureOuts) repeats(i int) int {
+	if i < len(c.counts) {
+		return c.counts[i]
+	}
+	return 1
+}
+
+// resetOutput discards all captured output, ready for
+// the process to be run again.
+func (c *CaptureOuts) resetOutput() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.lines = nil
+	c.streams = nil
+	c.times = nil
+	c.stages = nil
+	c.counts = nil
+	c.offsets = nil
+	c.nextOffset = 0
+	c.storedBytes = 0
+	c.tailHeld = 0
+	c.droppedLines = 0
+	c.lineSeq = 0
+	c.cutShort = false
+	c.captureStopped = false
+	c.stderrKillLine = nil
+	c.readErr = nil
+	c.skippedBlank = 0
+	c.rateDropped = 0
+	c.forceFlushed = 0
+	c.classCounts = nil
+	c.invalidUTF8 = 0
+	c.exitCode = -1
+	c.stdoutBytesRead.Store(0)
+	c.stderrBytesRead.Store(0)
+	c.stdoutDeltaMark.Store(0)
+	c.stderrDeltaMark.Store(0)
+}
+
+// finish records the final err in c.Err, along with the
+// exit code if the process ran, and then closes c.Done.
+// It returns err, as publicErr gives it.
+func (c *CaptureOuts) finish(err error) error {
+	err = c.publicErr(err)
+	c.stopSlogger()
+	c.closeSubs()
+	c.closeFramers()
+	c.closeRotating()
+	c.closeStdinFile()
+	c.mut.Lock()
+	c.Err = err
+	c.running = false
+	c.endTime = time.Now()
+	if c.cmd != nil && c.cmd.ProcessState != nil {
+		c.exitCode = c.cmd.ProcessState.ExitCode()
+	}
+	c.mut.Unlock()
+	close(c.Done)
+	return err
+}
+
+// capture starts a goroutine reading lines from r, which
+// is the given stream, and storing them; c.wg tracks it.
+func (c *CaptureOuts) capture(r io.Reader, a Stream) {
+	c.captureWG(r, a, 0, &c.wg)
+}
+
+// captureWG is capture, tracked by wg rather than c.wg, and
+// recording the pipeline stage that r's output comes from.
+func (c *CaptureOuts) captureWG(r io.Reader, a Stream, stage int, wg *sync.WaitGroup) {
+	wg.Add(1)
+	c.mut.Lock()
+	readDelay := c.readDelay
+	c.mut.Unlock()
+	if readDelay != nil {
+		r = &slowReader{r: r, delay: readDelay}
+	}
+	switch a {
+	case Stdout, Merged:
+		r = &countingReader{r: r, n: &c.stdoutBytesRead}
+	case Stderr:
+		r = &countingReader{r: r, n: &c.stderrBytesRead}
+	}
+	c.mut.Lock()
+	onRead := c.onRead
+	wrapper := c.readerWrapper
+	countOnly := c.countOnlyStdout && a == Stdout
+	assembly := c.assemblyTimeout
+	c.mut.Unlock()
+	if onRead != nil {
+		r = &readNotifier{r: r, a: a, fn: onRead, c: c}
+	}
+	dec := c.decoder()
+	eof := a
+	if eof == Merged {
+		eof = Stdout
+	}
+	c.mut.Lock()
+	c.eofOpen[eof]++
+	size := c.bufSizes[eof]
+	c.mut.Unlock()
+	if size <= 0 {
+		size = defaultBufSize
+	}
+	delim := c.delim
 
 	go func() {
-		defer c.wg.Done()
+		defer wg.Done()
+		defer c.streamEOF(a)
+		if countOnly {
+			_, err := io.Copy(io.Discard, r)
+			if err != nil {
+				c.noteReadError(a, err)
+			}
+			return
+		}
+		if wrapper != nil {
+			// drain whatever the wrapped reader leaves unread,
+			// so the child doesn't block writing to us.
+			defer io.Copy(io.Discard, r)
+			var wrapped io.Reader
+			c.safely("SetReaderWrapper function", func() { wrapped = wrapper(r) })
+			if wrapped == nil {
+				c.noteReadError(a, errors.New("the SetReaderWrapper function panicked, or returned nil"))
+				return
+			}
+			r = &safeReader{r: wrapped, c: c}
+		}
+		if a != Stdin {
+			// frames are the child's output, not what we fed it.
+			r = &frameTap{r: r, c: c}
+		}
+		if dec != nil {
+			r = dec.Reader(r)
+		}
+		bufreader := bufio.NewReaderSize(r, size)
+		if assembly > 0 {
+			c.readAssembling(bufreader, a, stage, delim, assembly)
+			return
+		}
+		// half accumulates the fragments of a line longer than
+		// bufreader's buffer, so that a very long line is
+		// assembled in amortized linear time, and materialized
+		// as a string just once, when its delimiter arrives.
+		var half bytes.Buffer
 		for {
-			var err error
-
-			for err == nil {
-				// get a fresh line each time, so we can save them without overwriting them.
-				line, err2 := bufreader.ReadString('\n') // line will include the newline character.
-				//vv("line = '%v'", line)
-				err = err2
-				if strings.HasSuffix(line, "\n") {
-					c.mut.Lock()
-					if c.halfline[a] != nil {
-						c.lines = append(c.lines, (*c.halfline[a])+line)
-						c.isStdErr = append(c.isStdErr, !isStdout)
-						c.halfline[a] = nil
-					} else {
-						c.lines = append(c.lines, line)
-						c.isStdErr = append(c.isStdErr, !isStdout)
-					}
-					//vv("saw full line, c.lines is now '%#v'", c.lines)
-					c.mut.Unlock()
+			if c.CaptureStopped() {
+				// drain, so the child doesn't block writing to us.
+				io.Copy(io.Discard, bufreader)
+				return
+			}
+			// ReadSlice returns just the first delimited record of
+			// what it has buffered, leaving the rest for our next
+			// call; so separate records are never merged into one
+			// line. The slice is only valid until the next read,
+			// so we copy it, into a fresh string or into half.
+			frag, err := bufreader.ReadSlice(delim) // frag will include the delimiter.
+			//vv("frag = '%v'", frag)
+			if len(frag) > 0 && frag[len(frag)-1] == delim {
+				var line string
+				if half.Len() > 0 {
+					half.Write(frag)
+					line = half.String()
+					half = bytes.Buffer{} // don't hold on to a huge buffer.
 				} else {
-					if line != "" {
-						c.halfline[a] = &line
-						//vv("saw half line '%s'", line)
-					}
+					line = string(frag)
 				}
+				c.addLine(line, a, stage)
+				//vv("saw full line '%s'", line)
+			} else if len(frag) > 0 {
+				half.Write(frag)
+				//vv("saw half line '%s'", frag)
 			}
-			if c.halfline[a] != nil && *c.halfline[a] != "" {
-				c.mut.Lock()
-				c.lines = append(c.lines, *(c.halfline[a]))
-				c.isStdErr = append(c.isStdErr, !isStdout)
-				c.mut.Unlock()
+			if err == bufio.ErrBufferFull {
+				continue
 			}
-			//vv("before the EOF check, n=%v, c.lines = '%#v', err='%v'", n, c.lines, err)
-			if err == io.EOF {
+			if err != nil {
+				// io.EOF, or some other error such as the pipe having
+				// been closed: either way there is nothing more to
+				// read, so flush any final unterminated line, exactly
+				// once, and stop. (Looping on a non-EOF error would
+				// spin forever, storing the half line again each time.)
+				if half.Len() > 0 {
+					c.addLine(half.String(), a, stage)
+				}
+				if err != io.EOF {
+					c.noteReadError(a, err)
+				}
+				//vv("at end of capture, err='%v'", err)
 				return
 			}
 		}
 	}()
 }
 
+// trimLine strips the delimiter from line, under
+// SetTrimNewline. The caller must hold c.mut.
+func (c *CaptureOuts) trimLine(line string) string {
+	if c.trimNewline {
+		line = strings.TrimSuffix(line, string(c.delim))
+		if c.delim == '\n' {
+			line = strings.TrimSuffix(line, "\r")
+		}
+	}
+	return line
+}
+
+// storeLine appends line, from stream a and the given stage,
+// captured at now, to the stored lines. The caller must hold
+// c.mut.
+func (c *CaptureOuts) storeLine(line string, a Stream, stage int, now time.Time) {
+	c.lines = append(c.lines, line)
+	c.streams = append(c.streams, a)
+	c.offsets = append(c.offsets, c.nextOffset)
+	c.nextOffset += int64(len(line) + len(c.lineEnd()))
+	if c.pipeline {
+		c.stages = append(c.stages, stage)
+	}
+	if c.timestamps {
+		c.times = append(c.times, now)
+	}
+	if c.collapse {
+		c.counts = append(c.counts, 1)
+	}
+}
+
+// addLine stores a completed line from stream a (and, in
+// ExecPipeline, the given stage), and then runs any line
+// callbacks on the calling capture goroutine, after
+// releasing c.mut.
+func (c *CaptureOuts) addLine(line string, a Stream, stage int) {
+	c.mut.Lock()
+	if c.captureStopped {
+		c.mut.Unlock()
+		return
+	}
+	line = c.trimLine(line)
+	if c.requireUTF8 && !utf8.ValidString(line) {
+		c.invalidUTF8++
+		if c.utf8Replace {
+			line = strings.ToValidUTF8(line, "\uFFFD")
+		}
+	}
+	if (c.stopAfterBlank || c.killAfterBlank) && a.isStdout() && strings.TrimSpace(strings.TrimSuffix(line, string(c.delim))) == "" {
+		c.captureStopped = true
+		kill := c.killAfterBlank
+		c.mut.Unlock()
+		if kill {
+			c.killProcs()
+		}
+		return
+	}
+	if c.skipBlank && strings.TrimSpace(strings.TrimSuffix(line, string(c.delim))) == "" {
+		c.skippedBlank++
+		c.mut.Unlock()
+		return
+	}
+	if c.maxLinesPerSec > 0 {
+		if now := time.Now(); now.Sub(c.rateStart) >= time.Second {
+			c.rateStart = now
+			c.rateCount = 0
+		}
+		if c.rateCount >= c.maxLinesPerSec {
+			c.rateDropped++
+			c.cutShort = true
+			c.mut.Unlock()
+			return
+		}
+		c.rateCount++
+	}
+	if c.captureUntil > 0 && c.storedBytes+int64(len(line)) >= c.captureUntil {
+		c.captureStopped = true
+		keep := c.captureUntil - c.storedBytes
+		if keep <= 0 {
+			c.mut.Unlock()
+			return
+		}
+		line = line[:keep]
+	}
+	sink := c.sink
+	var now time.Time
+	if c.timestamps {
+		now = time.Now()
+	}
+	keep := c.keepLines(a)
+	repeat := false
+	n := len(c.lines)
+	switch {
+	case !keep:
+		// only handed on, below.
+	case c.collapse && n > 0 && c.lines[n-1] == line && c.streams[n-1] == a &&
+		(!c.pipeline || c.stages[n-1] == stage):
+		// a repeat: just count it; but still hand it on below.
+		c.counts[n-1]++
+		c.nextOffset += int64(len(line) + len(c.lineEnd()))
+		keep = false
+		repeat = true
+	default:
+		c.storeLine(line, a, stage, now)
+	}
+	if !c.sawOutput {
+		c.sawOutput = true
+		close(c.firstOutput)
+	}
+	c.sawStream[a] = true
+	if c.lineAdded != nil {
+		close(c.lineAdded)
+		c.lineAdded = nil
+	}
+	if c.onIdle != nil {
+		c.lastLineAt = time.Now()
+	}
+	if !repeat {
+		c.storedBytes += int64(len(line))
+	}
+	if c.tailBytes > 0 && (keep || repeat) {
+		c.tailHeld += int64(len(line) + len(c.lineEnd()))
+		c.trimToTail()
+	}
+	onStderr := c.onStderrLine
+	kill := a == Stderr && c.killOnStderr && c.stderrKillLine == nil
+	if kill {
+		c.stderrKillLine = &line
+	}
+	c.logLine(line, a)
+	c.classify(line)
+	if c.builder != nil {
+		c.builder.WriteString(line)
+		c.builder.WriteString(c.lineEnd())
+	}
+	tee := c.teeCombined
+	teeLine := line + c.lineEnd()
+	ndjson := c.ndjson
+	seq := c.lineSeq
+	c.lineSeq++
+	var bcast chan bcastMsg
+	var binary bool
+	if c.nsubs > 0 {
+		bcast = c.bcast
+		binary = c.isBinary(line)
+	}
+	rotating := c.rotating
+	policy := c.teePolicy
+	var stdoutSink io.Writer
+	if a.isStdout() {
+		stdoutSink = c.stdoutSink
+	}
+	handoff := tee != nil || ndjson != nil || sink != nil || bcast != nil || rotating != nil || stdoutSink != nil
+	if handoff {
+		c.teeMut.Lock()
+	}
+	c.mut.Unlock()
+
+	killTee := false
+	if handoff {
+		// under StopTee or KillProcess, the first tee error
+		// ends the tee writes.
+		if policy == Ignore || c.teeErr == nil {
+			if tee != nil {
+				c.writeTee(tee, teeLine)
+			}
+			if ndjson != nil {
+				c.writeNDJSON(ndjson, line, a, seq)
+			}
+			if rotating != nil {
+				c.writeRotating(rotating, teeLine)
+			}
+			if stdoutSink != nil {
+				c.writeStdoutSink(stdoutSink, teeLine)
+			}
+		}
+		if sink != nil {
+			c.safely("LineSink.AddLine", func() { sink.AddLine(line, a == Stderr) })
+		}
+		if bcast != nil {
+			bcast <- bcastMsg{line: Line{Text: line, IsStdErr: a == Stderr, Stream: a, Time: now, Stage: stage, Count: 1, Binary: binary}}
+		}
+		if policy == KillProcess && c.teeErr != nil && !c.teeKilled {
+			c.teeKilled = true
+			killTee = true
+		}
+		c.teeMut.Unlock()
+	}
+
+	if kill || killTee {
+		c.killProcs()
+	}
+	if a == Stderr && onStderr != nil {
+		c.safely("OnStderrLine callback", func() { onStderr(line) })
+	}
+}
+
+// keepLines reports whether addLine should store a line from
+// a, or only hand it on, to a sink or subscribers. The caller
+// must hold c.mut.
+func (c *CaptureOuts) keepLines(a Stream) bool {
+	if c.sink != nil && c.sinkOnly {
+		return false
+	}
+	if c.stdoutSink != nil && !c.stdoutSinkKeep && a.isStdout() {
+		return false
+	}
+	return !(c.bufferUntilSub && c.handedOff)
+}
+
+// safely runs fn, which calls user supplied code (a callback,
+// or a tee writer) on one of our goroutines. If fn panics, we
+// recover, log the panic, and record it for CallbackErr(), so
+// that a buggy callback degrades gracefully instead of
+// crashing the host program, and capture carries on.
+func (c *CaptureOuts) safely(what string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("capture: recovered from panic in %v: '%v'", what, r)
+			log.Print(err)
+			c.callbackErr.CompareAndSwap(nil, &err)
+		}
+	}()
+	fn()
+}
+
+// CallbackErr returns an error describing the first panic
+// recovered from a user supplied callback or tee writer,
+// or nil if there has been none.
+func (c *CaptureOuts) CallbackErr() error {
+	if p := c.callbackErr.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
 /*
 func main() {
 
@@ -0,0 +1,948 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkReader returns each of its chunks from a single Read,
+// as a pipe does each write() of the child.
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunks) > 0 && len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+	}
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	return n, nil
+}
+
+func TestOneReadManyRecords(t *testing.T) {
+	for _, tc := range []struct {
+		delim byte
+		chunk string
+		want  []string
+	}{
+		{'\n', "a\nbb\n\nccc\n", []string{"a\n", "bb\n", "\n", "ccc\n"}},
+		{'\n', "a\nb", []string{"a\n", "b"}},
+		{0, "x\x00yy\x00\x00z", []string{"x\x00", "yy\x00", "\x00", "z"}},
+		{';', "k=1;k=2;", []string{"k=1;", "k=2;"}},
+	} {
+		c := NewCaptureOuts()
+		c.SetDelimiter(tc.delim)
+		err := c.CaptureReaders(&chunkReader{chunks: [][]byte{[]byte(tc.chunk)}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := c.GetComboOutSoFar(false)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("delimiter %q, one read of %q: got lines %q, want %q", tc.delim, tc.chunk, got, tc.want)
+		}
+	}
+}
+
+// splitAt cuts data into chunks, at the lengths given by the
+// bytes of cuts, in turn; 0 lengths give empty chunks.
+func splitAt(data, cuts []byte) (chunks [][]byte) {
+	for _, n := range cuts {
+		n := min(int(n), len(data))
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return append(chunks, data)
+}
+
+// FuzzCaptureReassembly checks that the lines stored from a
+// stream, however it is split up by the reads, add up to
+// exactly the bytes read: no byte dropped, duplicated or
+// reordered, whether lines are assembled by ReadSlice or,
+// with SetLineAssemblyTimeout, chunk by chunk.
+func FuzzCaptureReassembly(f *testing.F) {
+	f.Add([]byte("hello\nworld\n"), []byte{3, 0, 5}, byte('\n'), false, uint8(16))
+	f.Add([]byte("a\n\nb"), []byte{1, 1, 1}, byte('\n'), true, uint8(16))
+	f.Add([]byte("no delimiter at all"), []byte{7}, byte('\n'), false, uint8(16))
+	f.Add([]byte("x\x00yy\x00\x00z"), []byte{2, 2}, byte(0), true, uint8(16))
+	f.Add(bytes.Repeat([]byte("long line "), 100), []byte{13, 200, 77}, byte('\n'), false, uint8(16))
+	f.Fuzz(func(t *testing.T, data, cuts []byte, delim byte, assemble bool, bufSize uint8) {
+		c := NewCaptureOuts()
+		c.SetDelimiter(delim)
+		// small buffers exercise the half line stitching of
+		// ReadSlice's ErrBufferFull.
+		c.SetBufSizes(int(bufSize)%64+16, 0)
+		if assemble {
+			c.SetLineAssemblyTimeout(time.Nanosecond)
+		}
+		if err := c.CaptureReaders(&chunkReader{chunks: splitAt(data, cuts)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.BytesSoFar(); !bytes.Equal(got, data) {
+			t.Fatalf("stored %q, but read %q", got, data)
+		}
+	})
+}
+
+func TestExecContextKeepsOutput(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewCaptureOuts()
+	go func() {
+		// cancel once both lines are in.
+		for !c.Contains("two") {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	t0 := time.Now()
+	err := c.ExecContext(ctx, "sh", "-c", "echo one; echo two; sleep 5; echo never")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got err %v, want context.Canceled", err)
+	}
+	if el := time.Since(t0); el > 3*time.Second {
+		t.Errorf("ExecContext took %v to return after the cancel", el)
+	}
+	select {
+	case <-c.Done:
+	default:
+		t.Fatal("c.Done not closed")
+	}
+	got, _ := c.GetComboOutSoFar(false)
+	if want := []string{"one\n", "two\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
+
+// helperCommand is an execCommand that runs this test binary
+// as the child, to play the part given by name; see
+// TestHelperProcess.
+func helperCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=TestHelperProcess", "--", name}, args...)...)
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	return cmd
+}
+
+// TestHelperProcess isn't a real test: it is the child run by
+// helperCommand, which writes each of its arguments as a line
+// to stdout, or, for "err:" ones, to stderr, or for "sleep:"
+// ones, sleeps for the duration given, and then exits with
+// the code given by an "exit:" argument.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	code := 0
+	for _, arg := range args[min(len(args), 2):] {
+		switch {
+		case strings.HasPrefix(arg, "err:"):
+			fmt.Fprintln(os.Stderr, arg[len("err:"):])
+		case strings.HasPrefix(arg, "exit:"):
+			code, _ = strconv.Atoi(arg[len("exit:"):])
+		case strings.HasPrefix(arg, "sleep:"):
+			d, _ := time.ParseDuration(arg[len("sleep:"):])
+			time.Sleep(d)
+		default:
+			fmt.Println(arg)
+		}
+	}
+	os.Exit(code)
+}
+
+func TestExecHelper(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = helperCommand
+	if err := c.Exec("helper", "one", "err:two", "three"); err != nil {
+		t.Fatal(err)
+	}
+	got, isErr := c.GetComboOutSoFar(true)
+	if want := []string{"one\n", "two\n", "three\n"}; !reflect.DeepEqual(got, want) {
+		// stdout and stderr are read concurrently, so only the
+		// lines of each are in a guaranteed order.
+		var out, errs []string
+		for i, line := range got {
+			if isErr[i] {
+				errs = append(errs, line)
+			} else {
+				out = append(out, line)
+			}
+		}
+		if !reflect.DeepEqual(out, []string{"one\n", "three\n"}) || !reflect.DeepEqual(errs, []string{"two\n"}) {
+			t.Errorf("got lines %q, stderr %v", got, isErr)
+		}
+	}
+	if s := c.Snapshot(); s.ExitCode != 0 {
+		t.Errorf("got exit code %v, want 0", s.ExitCode)
+	}
+}
+
+func TestExecHelperExitCode(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = helperCommand
+	err := c.Exec("helper", "partial", "exit:3")
+	if !errors.Is(err, ErrWaitFailed) {
+		t.Fatalf("got err %v, want ErrWaitFailed", err)
+	}
+	if s := c.Snapshot(); s.ExitCode != 3 {
+		t.Errorf("got exit code %v, want 3", s.ExitCode)
+	}
+	if !c.Contains("partial") {
+		t.Errorf("output before the failure was lost: %q", c.BytesSoFar())
+	}
+}
+
+func TestExecStartFailed(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "/no/such/command/anywhere")
+	}
+	if err := c.Exec("helper"); !errors.Is(err, ErrStartFailed) {
+		t.Fatalf("got err %v, want ErrStartFailed", err)
+	}
+	if s := c.Snapshot(); s.ExitCode != -1 {
+		t.Errorf("got exit code %v, want -1", s.ExitCode)
+	}
+}
+
+func TestExecRetryHelper(t *testing.T) {
+	c := NewCaptureOuts()
+	attempts := 0
+	c.execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		// fail the first two attempts.
+		attempts++
+		if attempts < 3 {
+			args = append(args, "exit:1")
+		}
+		return helperCommand(ctx, name, args...)
+	}
+	if err := c.ExecRetry(5, time.Millisecond, "helper", "done"); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("ran %v attempts, want 3", attempts)
+	}
+	if got, _ := c.GetComboOutSoFar(false); !reflect.DeepEqual(got, []string{"done\n"}) {
+		t.Errorf("got lines %q, want only the last attempt's", got)
+	}
+}
+
+// TestSlowProducer slows each read of the child's output, as
+// a slow producer would, and checks that a subscriber still
+// gets every line, in order, before its channel is closed.
+func TestSlowProducer(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = helperCommand
+	c.setReadDelay(func() time.Duration { return 20 * time.Millisecond })
+	lines, cancel := c.Subscribe()
+	defer cancel()
+	go c.Exec("helper", "a", "b", "c")
+	var got []string
+	for line := range lines {
+		got = append(got, line.Text)
+	}
+	<-c.Done
+	if c.Err != nil {
+		t.Fatal(c.Err)
+	}
+	if want := []string{"a\n", "b\n", "c\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriber got %q, want %q", got, want)
+	}
+}
+
+func TestTrimNewline(t *testing.T) {
+	const input = "a\r\nb\n\nc"
+	for _, tc := range []struct {
+		trim   bool
+		lines  []string
+		bytes  string
+		output string
+	}{
+		{false, []string{"a\r\n", "b\n", "\n", "c"}, input, input},
+		// "\r\n" comes back as "\n", and the last line gains one.
+		{true, []string{"a", "b", "", "c"}, "a\nb\n\nc\n", "a\nb\n\nc"},
+	} {
+		c := NewCaptureOuts()
+		c.SetTrimNewline(tc.trim)
+		var tee bytes.Buffer
+		c.SetTeeCombined(&tee)
+		if err := c.CaptureReaders(&chunkReader{chunks: [][]byte{[]byte(input)}}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := c.GetComboOutSoFar(false); !reflect.DeepEqual(got, tc.lines) {
+			t.Errorf("trim %v: got lines %q, want %q", tc.trim, got, tc.lines)
+		}
+		if got := string(c.BytesSoFar()); got != tc.bytes {
+			t.Errorf("trim %v: BytesSoFar gave %q, want %q", tc.trim, got, tc.bytes)
+		}
+		if got := tee.String(); got != tc.bytes {
+			t.Errorf("trim %v: the tee got %q, want %q", tc.trim, got, tc.bytes)
+		}
+		if got, err := c.Output(); err != nil || got != tc.output {
+			t.Errorf("trim %v: Output gave %q, %v; want %q", tc.trim, got, err, tc.output)
+		}
+	}
+}
+
+// BenchmarkSubscribe1000 captures lines with 1000 subscribers
+// draining them, to show that the fan-out keeps up: the
+// capture goroutine hands each line to the broadcaster once,
+// however many subscribers there are.
+func BenchmarkSubscribe1000(b *testing.B) {
+	line := []byte("a line of output, of a typical length for a log\n")
+	data := bytes.Repeat(line, b.N)
+	b.SetBytes(int64(len(line)))
+	c := NewCaptureOuts()
+	done := make(chan int)
+	for i := 0; i < 1000; i++ {
+		lines, cancel := c.Subscribe()
+		defer cancel()
+		go func() {
+			n := 0
+			for range lines {
+				n++
+			}
+			done <- n
+		}()
+	}
+	b.ResetTimer()
+	if err := c.CaptureReaders(bytes.NewReader(data), nil); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if n := <-done; n != b.N {
+			b.Fatalf("a subscriber got %v lines, want %v", n, b.N)
+		}
+	}
+}
+
+// BenchmarkLongLine captures a single 100 MB line, arriving in
+// 64 KiB reads, as from a pipe; assembling it must take time
+// linear in its length.
+func BenchmarkLongLine(b *testing.B) {
+	const size, chunk = 100 << 20, 64 << 10
+	data := bytes.Repeat([]byte("x"), size)
+	data[size-1] = '\n'
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		r := &chunkReader{}
+		for off := 0; off < size; off += chunk {
+			r.chunks = append(r.chunks, data[off:min(off+chunk, size)])
+		}
+		c := NewCaptureOuts()
+		if err := c.CaptureReaders(r, nil); err != nil {
+			b.Fatal(err)
+		}
+		if got, _ := c.GetComboOutSoFar(false); len(got) != 1 || len(got[0]) != size {
+			b.Fatalf("got %v lines, want one of %v bytes", len(got), size)
+		}
+	}
+}
+
+func TestTranscriptRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(c *CaptureOuts)
+		input string
+	}{
+		{"plain", func(c *CaptureOuts) {}, "a\nb\n"},
+		{"trimmed", func(c *CaptureOuts) { c.SetTrimNewline(true) }, "a\nb\n"},
+		{"delimiter", func(c *CaptureOuts) { c.SetDelimiter(';') }, "k=1;k=2;"},
+		{"trimmed delimiter", func(c *CaptureOuts) { c.SetDelimiter(0); c.SetTrimNewline(true) }, "x\x00y\x00"},
+		{"collapsed", func(c *CaptureOuts) { c.SetCollapseRepeats(true) }, "a\na\na\nb\n"},
+	} {
+		c := NewCaptureOuts()
+		tc.setup(c)
+		if err := c.CaptureReaders(strings.NewReader(tc.input), nil); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := c.WriteTranscript(&b); err != nil {
+			t.Fatal(err)
+		}
+		back, err := ReadTranscript(&b)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if got := string(back.BytesSoFar()); got != tc.input {
+			t.Errorf("%v: read back %q, want %q", tc.name, got, tc.input)
+		}
+		want, _ := c.GetComboOutSoFar(false)
+		if got, _ := back.GetComboOutSoFar(false); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: read back lines %q, want %q", tc.name, got, want)
+		}
+	}
+}
+
+func TestCollapseRepeatsExpanded(t *testing.T) {
+	const input = "a\na\na\nb\nb\n"
+	want := []string{"a\n", "a\n", "a\n", "b\n", "b\n"}
+	c := NewCaptureOuts()
+	c.SetCollapseRepeats(true)
+	var live bytes.Buffer
+	c.StreamNDJSON(&live)
+	if err := c.CaptureReaders(strings.NewReader(input), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(c.CollapsedLines()); got != 2 {
+		t.Fatalf("stored %v lines, want 2 collapsed ones", got)
+	}
+	if got, _ := c.Output(); got != strings.TrimSuffix(input, "\n") {
+		t.Errorf("Output gave %q", got)
+	}
+	if s := c.Snapshot(); !reflect.DeepEqual(s.Lines, want) || len(s.IsStdErr) != len(want) || s.LineCount != len(want) {
+		t.Errorf("Snapshot gave %q, %v, count %v", s.Lines, s.IsStdErr, s.LineCount)
+	}
+	if got, err := io.ReadAll(c.StdoutReader()); err != nil || string(got) != input {
+		t.Errorf("StdoutReader gave %q, %v", got, err)
+	}
+	var backlog bytes.Buffer
+	c.StreamNDJSON(&backlog)
+	for _, b := range []*bytes.Buffer{&live, &backlog} {
+		var seqs []int
+		for _, js := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			var ln ndjsonLine
+			if err := json.Unmarshal([]byte(js), &ln); err != nil {
+				t.Fatal(err)
+			}
+			seqs = append(seqs, ln.Seq)
+		}
+		if !reflect.DeepEqual(seqs, []int{0, 1, 2, 3, 4}) {
+			t.Errorf("NDJSON seqs %v, want 0 to 4", seqs)
+		}
+	}
+}
+
+func TestSeedLinesStoredOnly(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = helperCommand
+	c.SetKillOnStderr(true)
+	c.SetTrimNewline(true)
+	var tee bytes.Buffer
+	c.SetTeeCombined(&tee)
+	if err := c.SeedLines([]string{"seeded\n", "seeded error\n"}, []bool{false, true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Exec("helper", "ran"); err != nil {
+		t.Fatalf("a seeded stderr line failed the run: %v", err)
+	}
+	if got, _ := c.GetComboOutSoFar(false); !reflect.DeepEqual(got, []string{"seeded", "seeded error", "ran"}) {
+		t.Errorf("got lines %q", got)
+	}
+	if got := tee.String(); got != "ran\n" {
+		t.Errorf("the tee got %q, want only the run's line", got)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(c *CaptureOuts)
+		run   func(c *CaptureOuts) error
+		want  bool
+	}{
+		{"plain", func(c *CaptureOuts) {}, func(c *CaptureOuts) error {
+			return c.Exec("helper", "a", "b")
+		}, false},
+		{"sequence markers", func(c *CaptureOuts) {}, func(c *CaptureOuts) error {
+			return c.ExecSequence([][]string{{"helper", "a"}, {"helper", "b"}})
+		}, false},
+		{"stdin tee", func(c *CaptureOuts) {
+			c.SetStdin(strings.NewReader("in\n"))
+			c.SetStdinTee(true)
+		}, func(c *CaptureOuts) error {
+			return c.Exec("helper", "a")
+		}, false},
+		{"tail bytes", func(c *CaptureOuts) { c.SetTailBytes(3) }, func(c *CaptureOuts) error {
+			return c.Exec("helper", "a", "b")
+		}, true},
+	} {
+		c := NewCaptureOuts()
+		c.execCommand = helperCommand
+		tc.setup(c)
+		if err := tc.run(c); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if got := c.Truncated(); got != tc.want {
+			lines, _ := c.GetComboOutSoFar(false)
+			t.Errorf("%v: Truncated() = %v, want %v; lines %q", tc.name, got, tc.want, lines)
+		}
+	}
+}
+
+func TestFrameChanLeavesOutStdin(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = helperCommand
+	c.SetStdin(strings.NewReader("sent\n"))
+	c.SetStdinTee(true)
+	frames := c.FrameChan(0)
+	var got []byte
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for f := range frames {
+			got = append(got, f...)
+		}
+	}()
+	if err := c.Exec("helper", "out"); err != nil {
+		t.Fatal(err)
+	}
+	<-read
+	if string(got) != "out\n" {
+		t.Errorf("frames gave %q, want only the child's output", got)
+	}
+	if !c.Contains("sent") {
+		t.Errorf("the stdin tee was not captured: %q", c.BytesSoFar())
+	}
+}
+
+// wrapStage is a SetErrorWrapper that keeps none of the
+// error, so that nothing can depend on what it wraps.
+func wrapStage(stage string, err error) error {
+	return errors.New("wrapped " + stage)
+}
+
+func TestExecRetryWrappedCancel(t *testing.T) {
+	c := NewCaptureOuts()
+	c.SetErrorWrapper(wrapStage)
+	attempts := 0
+	c.execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		attempts++
+		return helperCommand(ctx, name, args...)
+	}
+	cancelled := make(chan struct{})
+	close(cancelled)
+	c.SetCancelChan(cancelled)
+	err := c.ExecRetry(3, time.Millisecond, "helper", "sleep:10s", "exit:1")
+	if err == nil || err.Error() != "wrapped context" {
+		t.Errorf("got err %v, want the wrapper's", err)
+	}
+	if attempts != 1 {
+		t.Errorf("ran %v attempts after the cancel, want 1", attempts)
+	}
+}
+
+func TestSuperviseWrappedStartFailure(t *testing.T) {
+	c := NewCaptureOuts()
+	c.SetErrorWrapper(wrapStage)
+	attempts := 0
+	c.execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		attempts++
+		return exec.CommandContext(ctx, "/no/such/command/anywhere")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Supervise(ctx, time.Millisecond, "helper")
+	if c.Err == nil || c.Err.Error() != "wrapped start" {
+		t.Errorf("got err %v, want the wrapper's", c.Err)
+	}
+	if attempts != 1 {
+		t.Errorf("a command that cannot start was run %v times", attempts)
+	}
+}
+
+func TestTailBytesCollapsed(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		tail  int
+		want  string
+	}{
+		{"xx\nxx\nxx\nxx\nxx\nxx\n", 6, "xx\nxx\n"},
+		// a run can't be cut, so a line short.
+		{"xx\nxx\nxx\nxx\nxx\nxx\n", 7, "xx\nxx\n"},
+		// a run down to one line is cut as usual.
+		{"xx\nxx\nxx\nabc\n", 6, "x\nabc\n"},
+		{"abcdef\nxx\nxx\nxx\n", 8, "xx\nxx\n"},
+	} {
+		c := NewCaptureOuts()
+		c.SetCollapseRepeats(true)
+		c.SetTailBytes(tc.tail)
+		if err := c.CaptureReaders(strings.NewReader(tc.input), nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(c.BytesSoFar()); got != tc.want {
+			t.Errorf("tail %v of %q: BytesSoFar gave %q, want %q", tc.tail, tc.input, got, tc.want)
+		}
+		lines, _ := c.GetComboOutSoFar(false)
+		if got := strings.Join(lines, ""); got != tc.want {
+			t.Errorf("tail %v of %q: GetComboOutSoFar gave %q, want %q", tc.tail, tc.input, got, tc.want)
+		}
+		if !c.Truncated() {
+			t.Errorf("tail %v of %q: not Truncated", tc.tail, tc.input)
+		}
+	}
+}
+
+func TestTailBytesTrimNewline(t *testing.T) {
+	for _, tc := range []struct {
+		tail int
+		want string
+	}{
+		{5, "c\ndd\n"},
+		{3, "dd\n"},
+		{1, "\n"},
+	} {
+		c := NewCaptureOuts()
+		c.SetTrimNewline(true)
+		c.SetTailBytes(tc.tail)
+		if err := c.CaptureReaders(strings.NewReader("a\nbb\ncc\ndd\n"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(c.BytesSoFar()); got != tc.want {
+			t.Errorf("tail %v: BytesSoFar gave %q, want %q", tc.tail, got, tc.want)
+		}
+	}
+}
+
+func TestSeedLinesLimits(t *testing.T) {
+	c := NewCaptureOuts()
+	c.SetCombinedMaxBytes(10)
+	if err := c.SeedLines([]string{"0123456789\n"}, []bool{false}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CaptureReaders(strings.NewReader("later\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.BytesSoFar()); got != "0123456789\n" {
+		t.Errorf("with the limit reached by seeding, got %q", got)
+	}
+	if !c.Truncated() {
+		t.Error("the line captured after the limit was reached was dropped, but not Truncated")
+	}
+
+	c = NewCaptureOuts()
+	c.SetTailBytes(4)
+	if err := c.SeedLines([]string{"012\n", "345\n"}, []bool{false, false}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.BytesSoFar()); got != "345\n" {
+		t.Errorf("seeding over the tail kept %q", got)
+	}
+	if err := c.CaptureReaders(strings.NewReader("x\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.BytesSoFar()); got != "5\nx\n" {
+		t.Errorf("a captured line after seeding kept %q", got)
+	}
+}
+
+func TestStdoutSinkNotDropped(t *testing.T) {
+	c := NewCaptureOuts()
+	var sink bytes.Buffer
+	c.SetStdoutSink(&sink, false)
+	if err := c.CaptureReaders(strings.NewReader("out\n"), strings.NewReader("err\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.DroppedLines(); n != 0 {
+		t.Errorf("DroppedLines() = %v for lines only sent to the sink", n)
+	}
+	if got, _ := c.GetComboOutSoFar(false); !reflect.DeepEqual(got, []string{"err\n"}) {
+		t.Errorf("stored %q, want only stderr", got)
+	}
+	if sink.String() != "out\n" {
+		t.Errorf("the sink got %q", sink.String())
+	}
+}
+
+func TestComboOutLimitedFront(t *testing.T) {
+	c := NewCaptureOuts()
+	var sink bytes.Buffer
+	c.SetStdoutSink(&sink, false)
+	if err := c.CaptureReaders(strings.NewReader("out\n"), strings.NewReader("err\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got, front := c.GetComboOutLimited(100); !reflect.DeepEqual(got, []string{"err\n"}) || front {
+		t.Errorf("got %q, truncatedFront %v; want only stderr, and nothing left out", got, front)
+	}
+
+	c = NewCaptureOuts()
+	if err := c.CaptureReaders(strings.NewReader("a\nb\nc\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, front := c.GetComboOutLimited(4); !reflect.DeepEqual(got, []string{"b\n", "c\n"}) || !front {
+		t.Errorf("got %q, truncatedFront %v; want the last two lines, and the first left out", got, front)
+	}
+	if got, front := c.GetComboOutLimited(6); len(got) != 3 || front {
+		t.Errorf("got %q, truncatedFront %v; want all, and nothing left out", got, front)
+	}
+}
+
+func TestSuperviseWrappedCancelInDelay(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = helperCommand
+	c.SetErrorWrapper(wrapStage)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// cancel once the first run is over, in the delay.
+		for !c.Contains("ran") || c.Snapshot().Running {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	c.Supervise(ctx, time.Minute, "helper", "ran")
+	if c.Err == nil || c.Err.Error() != "wrapped context" {
+		t.Errorf("got err %v, want the wrapper's", c.Err)
+	}
+}
+
+func TestSequenceWrappedError(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = helperCommand
+	var seen error
+	c.SetErrorWrapper(func(stage string, err error) error {
+		seen = err
+		return errors.New("wrapped " + stage)
+	})
+	err := c.ExecSequence([][]string{{"helper", "a"}, {"helper", "b", "exit:2"}})
+	if err == nil || err.Error() != "wrapped wait" {
+		t.Errorf("got err %v, want the wrapper's, unchanged", err)
+	}
+	if seen == nil || !strings.Contains(seen.Error(), "at step 2/2: 'helper b exit:2'") {
+		t.Errorf("the wrapper was given %v, without the step", seen)
+	}
+	var ee *exec.ExitError
+	if !errors.As(seen, &ee) || ee.ExitCode() != 2 {
+		t.Errorf("the wrapper was given %v, not wrapping the exit error", seen)
+	}
+}
+
+func TestOnReadPanic(t *testing.T) {
+	c := NewCaptureOuts()
+	calls := 0
+	c.OnRead(func(stream Stream, n int) {
+		calls++
+		panic("boom")
+	})
+	r := &chunkReader{chunks: [][]byte{[]byte("a\n"), []byte("b\n")}}
+	if err := c.CaptureReaders(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.GetComboOutSoFar(false); !reflect.DeepEqual(got, []string{"a\n", "b\n"}) {
+		t.Errorf("capture did not carry on after the panic: %q", got)
+	}
+	if err := c.CallbackErr(); err == nil || !strings.Contains(err.Error(), "OnRead") {
+		t.Errorf("CallbackErr() = %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("OnRead called %v times; want it off after its panic", calls)
+	}
+}
+
+// panicReader panics on its second Read.
+type panicReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (pr *panicReader) Read(p []byte) (int, error) {
+	if pr.reads++; pr.reads > 1 {
+		panic("boom")
+	}
+	return pr.r.Read(p)
+}
+
+func TestReaderWrapperPanic(t *testing.T) {
+	c := NewCaptureOuts()
+	c.SetReaderWrapper(func(r io.Reader) io.Reader { return &panicReader{r: r} })
+	r := &chunkReader{chunks: [][]byte{[]byte("a\n"), []byte("b\n")}}
+	if err := c.CaptureReaders(r, nil); !errors.Is(err, ErrReadFailed) {
+		t.Errorf("got err %v, want ErrReadFailed", err)
+	}
+	if got, _ := c.GetComboOutSoFar(false); !reflect.DeepEqual(got, []string{"a\n"}) {
+		t.Errorf("got lines %q, want those read before the panic", got)
+	}
+	if err := c.CallbackErr(); err == nil || !strings.Contains(err.Error(), "SetReaderWrapper") {
+		t.Errorf("CallbackErr() = %v", err)
+	}
+
+	c = NewCaptureOuts()
+	c.SetReaderWrapper(func(r io.Reader) io.Reader { panic("boom") })
+	if err := c.CaptureReaders(strings.NewReader("a\n"), nil); !errors.Is(err, ErrReadFailed) {
+		t.Errorf("with fn panicking, got err %v, want ErrReadFailed", err)
+	}
+}
+
+func TestLineRunesCollapsed(t *testing.T) {
+	c := NewCaptureOuts()
+	c.SetCollapseRepeats(true)
+	if err := c.CaptureReaders(strings.NewReader("a\na\nb\né\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := c.GetComboOutSoFar(false)
+	for i := -1; i <= len(want); i++ {
+		got, ok := c.LineRunes(i)
+		if in := i >= 0 && i < len(want); ok != in || in && string(got) != want[i] {
+			t.Errorf("LineRunes(%v) = %q, %v; GetComboOutSoFar has %q", i, string(got), ok, want)
+		}
+	}
+}
+
+func TestFlushEveryTee(t *testing.T) {
+	c := NewCaptureOuts()
+	var tee, sink, ndjson bytes.Buffer
+	teeW, sinkW, ndjsonW := bufio.NewWriter(&tee), bufio.NewWriter(&sink), bufio.NewWriter(&ndjson)
+	c.SetTeeCombined(teeW)
+	c.SetStdoutSink(sinkW, true)
+	c.StreamNDJSON(ndjsonW)
+	c.SetTeeFlushInterval(time.Hour)
+	c.execCommand = helperCommand
+	if err := c.Exec("helper", "out"); err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string]*bytes.Buffer{"tee": &tee, "stdout sink": &sink, "NDJSON stream": &ndjson} {
+		if !strings.Contains(b.String(), "out") {
+			t.Errorf("the %v was not flushed: got %q", name, b.String())
+		}
+	}
+}
+
+func TestKillAfterBlankLine(t *testing.T) {
+	c := NewCaptureOuts()
+	c.execCommand = helperCommand
+	c.SetKillAfterBlankLine(true)
+	t0 := time.Now()
+	err := c.Exec("helper", "Header: 1", "", "body", "sleep:10s")
+	if !errors.Is(err, ErrWaitFailed) {
+		t.Errorf("got err %v, want the kill reported", err)
+	}
+	if el := time.Since(t0); el > 5*time.Second {
+		t.Errorf("the process ran on for %v after the blank line", el)
+	}
+	if got, _ := c.GetComboOutSoFar(false); !reflect.DeepEqual(got, []string{"Header: 1\n"}) {
+		t.Errorf("got lines %q, want just the header", got)
+	}
+	if !c.CaptureStopped() {
+		t.Error("CaptureStopped() is false")
+	}
+}
+
+func TestPipelineStartFailureLeaksNoFds(t *testing.T) {
+	fds := func() int {
+		ents, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("no /proc/self/fd")
+		}
+		return len(ents)
+	}
+	run := func() {
+		c := NewCaptureOuts()
+		c.execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+			if name == "missing" {
+				return exec.CommandContext(ctx, "/no/such/command/anywhere")
+			}
+			return helperCommand(ctx, name, args...)
+		}
+		if err := c.ExecPipeline([]string{"missing"}, []string{"helper", "a"}, []string{"helper", "b"}); !errors.Is(err, ErrStartFailed) {
+			t.Fatalf("got err %v, want ErrStartFailed", err)
+		}
+	}
+	run()
+	before := fds()
+	for i := 0; i < 10; i++ {
+		run()
+	}
+	if after := fds(); after > before {
+		t.Errorf("%v fds open after 10 failed pipelines, from %v", after, before)
+	}
+}
+
+func TestPTYSize(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no /dev/ptmx")
+	}
+	for _, cmd := range []string{"stty", "sh"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("no %v", cmd)
+		}
+	}
+	c := NewCaptureOuts()
+	c.SetPTY(true)
+	c.SetPTYSize(33, 101)
+	if err := c.Exec("stty", "size"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.BytesSoFar()); got != "33 101\r\n" {
+		t.Errorf("stty size gave %q, want the size set", got)
+	}
+
+	c = NewCaptureOuts()
+	c.SetPTY(true)
+	c.SetPTYSize(33, 101)
+	go func() {
+		for !c.Snapshot().Running {
+			time.Sleep(time.Millisecond)
+		}
+		if err := c.ResizePTY(40, 120); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := c.Exec("sh", "-c", "sleep 0.5; stty size"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.BytesSoFar()); got != "40 120\r\n" {
+		t.Errorf("after ResizePTY, stty size gave %q", got)
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	type msg struct{ N int }
+	c := NewCaptureOuts()
+	evs, cancel := c.JSONLines(msg{})
+	defer cancel()
+	if err := c.CaptureReaders(strings.NewReader("{\"N\":1}\nnope\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	var got []JSONEvent
+	for ev := range evs {
+		got = append(got, ev)
+	}
+	if len(got) != 2 || got[0].Err != nil || got[0].Value.(*msg).N != 1 || got[1].Err == nil || got[1].Line != "nope\n" {
+		t.Errorf("got %+v", got)
+	}
+
+	c = NewCaptureOuts()
+	c.SetMaxSubscribers(1)
+	_, unsub := c.Subscribe()
+	defer unsub()
+	evs, _ = c.JSONLines(msg{})
+	if ev, ok := <-evs; !ok || ev.Err == nil {
+		t.Errorf("want an error event past SetMaxSubscribers, got %+v, %v", ev, ok)
+	}
+	if _, ok := <-evs; ok {
+		t.Error("the channel is not closed after the error event")
+	}
+
+	c = NewCaptureOuts()
+	evs, cancel = c.JSONLines(msg{})
+	cancel()
+	select {
+	case _, ok := <-evs:
+		if ok {
+			t.Error("got an event after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("cancel did not close the channel")
+	}
+}
@@ -0,0 +1,46 @@
+// Package capturetest has test helpers for code using
+// package capture, kept apart so that package capture
+// itself does not depend on package testing.
+package capturetest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/glycerine/capture"
+)
+
+// maxStderrLines bounds how much stderr a failure reports.
+const maxStderrLines = 50
+
+// AssertSuccess waits for c to complete, and then fails t,
+// with a message giving the command, its exit code and error,
+// and the last of its stderr, unless it exited 0 without
+// error. It turns the usual several line check into one call.
+func AssertSuccess(t testing.TB, c *capture.CaptureOuts) {
+	t.Helper()
+	<-c.DoneChan()
+	snap := c.Snapshot()
+	if snap.Err == nil && snap.ExitCode == 0 {
+		return
+	}
+	var stderr []string
+	for i, line := range snap.Lines {
+		if snap.IsStdErr[i] {
+			stderr = append(stderr, line)
+		}
+	}
+	omitted := ""
+	if len(stderr) > maxStderrLines {
+		omitted = "  ...\n"
+		stderr = stderr[len(stderr)-maxStderrLines:]
+	}
+	var b strings.Builder
+	for _, line := range stderr {
+		b.WriteString("  ")
+		b.WriteString(strings.TrimRight(line, "\r\n"))
+		b.WriteString("\n")
+	}
+	t.Fatalf("process did not exit cleanly: %v\nexit code: %v\nerr: %v\nstderr:\n%v%v",
+		c, snap.ExitCode, snap.Err, omitted, b.String())
+}
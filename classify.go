@@ -0,0 +1,49 @@
+package capture
+
+// SetLineClassifier arranges for fn to be called with each
+// completed line, from either stream, as it is captured, to
+// put it in a class: its log level, say. ClassCounts then
+// reports, live, how many lines have fallen in each class,
+// such as "142 ERROR, 5000 INFO", without a second pass over
+// the output. A line for which fn returns "" is not counted.
+// fn sees the line as it is stored, and is called for every
+// line, even one that is not kept in memory; but not for
+// skipped blank lines. fn runs on the capture goroutine
+// with c's lock held, so it must be quick, and must not
+// call c's methods. A nil fn turns classifying off. Call it
+// before Exec.
+func (c *CaptureOuts) SetLineClassifier(fn func(line string) string) {
+	c.mut.Lock()
+	c.classifier = fn
+	c.mut.Unlock()
+}
+
+// ClassCounts returns a copy of the number of lines seen so
+// far in each class, as decided by the SetLineClassifier
+// function. It is empty if there is none.
+func (c *CaptureOuts) ClassCounts() map[string]int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	m := make(map[string]int, len(c.classCounts))
+	for k, v := range c.classCounts {
+		m[k] = v
+	}
+	return m
+}
+
+// classify counts line in its class. The caller must hold
+// c.mut.
+func (c *CaptureOuts) classify(line string) {
+	if c.classifier == nil {
+		return
+	}
+	var class string
+	c.safely("line classifier", func() { class = c.classifier(line) })
+	if class == "" {
+		return
+	}
+	if c.classCounts == nil {
+		c.classCounts = make(map[string]int)
+	}
+	c.classCounts[class]++
+}
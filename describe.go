@@ -0,0 +1,151 @@
+package capture
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Describe returns a human readable, multi-line summary of the
+// capture state: the command, its pid, whether it is running,
+// how many lines and bytes have been captured from each
+// stream, whether any output was truncated or discarded, and
+// the exit code and error once finished. It is meant as a
+// one-call diagnostic to paste into logs or support tickets,
+// and is safe to call at any time.
+func (c *CaptureOuts) Describe() string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	st := c.stats()
+	state := c.state()
+	truncated := c.truncated()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "command:   %v\n", c.cmdLine)
+	fmt.Fprintf(&b, "pid:       %v\n", c.pid)
+	fmt.Fprintf(&b, "state:     %v\n", state)
+	fmt.Fprintf(&b, "stdout:    %v lines, %v bytes stored, %v bytes read\n", st.StdoutLines, st.StdoutBytes, c.stdoutBytesRead.Load())
+	fmt.Fprintf(&b, "stderr:    %v lines, %v bytes stored, %v bytes read\n", st.StderrLines, st.StderrBytes, c.stderrBytesRead.Load())
+	fmt.Fprintf(&b, "truncated: %v\n", truncated)
+	fmt.Fprintf(&b, "exit code: %v\n", c.exitCode)
+	fmt.Fprintf(&b, "err:       %v\n", c.Err)
+	return b.String()
+}
+
+// String returns a short, one line summary of the capture,
+// such as
+//
+//	CaptureOuts{"ls -l", finished, 12 lines, exit code 0}
+//
+// so that logging a *CaptureOuts with %v is readable, and
+// doesn't race with the capture goroutines as printing the
+// struct's fields would.
+func (c *CaptureOuts) String() string {
+	if c == nil {
+		return "CaptureOuts(nil)"
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	state := c.state()
+	if state == "finished" {
+		state = fmt.Sprintf("finished, %v lines, exit code %v", len(c.lines), c.exitCode)
+	} else {
+		state = fmt.Sprintf("%v, %v lines", state, len(c.lines))
+	}
+	return fmt.Sprintf("CaptureOuts{%q, %v}", c.cmdLine, state)
+}
+
+// state describes where c is in its life: "not started",
+// "running" or "finished". The caller must hold c.mut.
+func (c *CaptureOuts) state() string {
+	switch {
+	case c.running:
+		return "running"
+	case c.isDone():
+		return "finished"
+	}
+	return "not started"
+}
+
+// Truncated reports whether any captured output has been
+// cut short or discarded, as by SetCombinedMaxBytes (or
+// SetCaptureUntilBytes), SetTailBytes or
+// SetMaxLinesPerSecond.
+func (c *CaptureOuts) Truncated() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.truncated()
+}
+
+// truncated does the work of Truncated. Lines that were only
+// handed on, as to a sink, don't count. The caller must hold
+// c.mut.
+func (c *CaptureOuts) truncated() bool {
+	return c.captureStopped || c.cutShort
+}
+
+// Stats holds counters describing a capture,
+// as returned by Stats().
+type Stats struct {
+	// StdoutLines and StderrLines count the lines
+	// currently stored from each stream, and StdoutBytes
+	// and StderrBytes the bytes in those lines. Merged
+	// lines (PTY mode) count as stdout.
+	StdoutLines int
+	StderrLines int
+	StdoutBytes int64
+	StderrBytes int64
+
+	// SkippedBlankLines counts the lines not stored
+	// because of SetSkipBlankLines(true).
+	SkippedBlankLines int
+
+	// InvalidUTF8Lines counts the lines found not to be
+	// valid UTF-8 with SetRequireUTF8, whether replaced or
+	// flagged.
+	InvalidUTF8Lines int
+
+	// RateDroppedLines counts the lines not stored because
+	// of SetMaxLinesPerSecond.
+	RateDroppedLines int
+
+	// ForceFlushedLines counts the partial lines stored
+	// early because of SetLineAssemblyTimeout.
+	ForceFlushedLines int
+}
+
+// Stats returns the current counters for the capture.
+func (c *CaptureOuts) Stats() Stats {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.stats()
+}
+
+// stats does the work of Stats. The caller must hold c.mut.
+func (c *CaptureOuts) stats() (s Stats) {
+	for i, line := range c.lines {
+		switch c.streams[i] {
+		case Stdout, Merged:
+			s.StdoutLines++
+			s.StdoutBytes += int64(len(line))
+		case Stderr:
+			s.StderrLines++
+			s.StderrBytes += int64(len(line))
+		}
+	}
+	s.SkippedBlankLines = c.skippedBlank
+	s.InvalidUTF8Lines = c.invalidUTF8
+	s.RateDroppedLines = c.rateDropped
+	s.ForceFlushedLines = c.forceFlushed
+	return
+}
+
+// isDone reports whether c.Done has been closed.
+func (c *CaptureOuts) isDone() bool {
+	select {
+	case <-c.Done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,92 @@
+package capture
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// DumpToFiles waits for the process to finish (for c.Done
+// to be closed), and then writes the captured stdout lines
+// to stdoutPath and the captured stderr lines to stderrPath,
+// creating or truncating each file. Writes are buffered,
+// and the files are closed without an fsync. If either
+// file cannot be written, the returned error reports all
+// the failures.
+func (c *CaptureOuts) DumpToFiles(stdoutPath, stderrPath string) error {
+	<-c.Done
+	lines, streams := c.linesSoFar()
+	end := c.getLineEnd()
+	return errors.Join(
+		writeLinesToFile(stdoutPath, lines, end, func(i int) (string, bool) { return "", streams[i].isStdout() }),
+		writeLinesToFile(stderrPath, lines, end, func(i int) (string, bool) { return "", streams[i] == Stderr }),
+	)
+}
+
+// DumpCombined waits for the process to finish, and then
+// writes all the captured lines to path, in capture order,
+// each prefixed by stdoutTag or stderrTag according to the
+// stream it came from. This gives a merged, annotated
+// transcript of the run on disk. Lines captured with
+// SetStdinTee(true) are left out; ExecSequence's step
+// markers are kept, untagged. Like DumpToFiles, the
+// writes are buffered and the file is closed without an fsync.
+func (c *CaptureOuts) DumpCombined(path, stdoutTag, stderrTag string) error {
+	<-c.Done
+	lines, streams := c.linesSoFar()
+	return writeLinesToFile(path, lines, c.getLineEnd(), func(i int) (string, bool) {
+		switch streams[i] {
+		case Stdout, Merged:
+			return stdoutTag, true
+		case Stderr:
+			return stderrTag, true
+		case Marker:
+			return "", true
+		}
+		return "", false
+	})
+}
+
+// getLineEnd returns c.lineEnd(), under the lock.
+func (c *CaptureOuts) getLineEnd() string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.lineEnd()
+}
+
+// writeLinesToFile creates path and writes to it each of
+// lines for which want(i) returns true, preceded by the
+// prefix that want(i) also returns, and followed by end.
+func writeLinesToFile(path string, lines []string, end string, want func(i int) (prefix string, ok bool)) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error in CaptureOuts dump: could not create '%s': '%v'", path, err)
+	}
+	w := bufio.NewWriter(f)
+	for i, line := range lines {
+		prefix, ok := want(i)
+		if !ok {
+			continue
+		}
+		if _, err = w.WriteString(prefix); err != nil {
+			break
+		}
+		if _, err = w.WriteString(line); err != nil {
+			break
+		}
+		if _, err = w.WriteString(end); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("error in CaptureOuts dump: could not write '%s': '%v'", path, err)
+	}
+	return nil
+}
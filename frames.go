@@ -0,0 +1,125 @@
+package capture
+
+import (
+	"io"
+	"sync"
+)
+
+// FrameChan returns a channel delivering the child's raw
+// output, stdout and stderr together in the order it is read,
+// as byte frames of at most maxFrameBytes each: small reads
+// are coalesced while the consumer is busy, and large ones
+// split. For terminal-in-browser apps streaming TUI output
+// over a websocket, this suits better than lines, since it
+// includes partial lines and bare carriage returns as soon as
+// they arrive. The bytes are those read from the pipes, before
+// any SetEncoding decoding. Each frame is a fresh copy. Only
+// output read after the call is delivered, so call it before
+// Exec. The channel is closed once capture is complete and
+// the last frame sent. A consumer that falls more than a few
+// frames behind holds up capture until it catches up.
+// maxFrameBytes < 1 is taken as 32 KiB.
+func (c *CaptureOuts) FrameChan(maxFrameBytes int) <-chan []byte {
+	if maxFrameBytes < 1 {
+		maxFrameBytes = 32 << 10
+	}
+	f := &framer{max: maxFrameBytes, ch: make(chan []byte)}
+	f.cond = sync.NewCond(&f.mu)
+	c.mut.Lock()
+	if c.framesClosed {
+		f.closed = true
+	} else {
+		c.framers = append(c.framers, f)
+	}
+	c.mut.Unlock()
+	go f.run()
+	return f.ch
+}
+
+// framer gathers raw output for one FrameChan.
+type framer struct {
+	max int
+	ch  chan []byte
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+}
+
+// limit is how much a framer buffers before writes block.
+func (f *framer) limit() int {
+	return 4 * f.max
+}
+
+func (f *framer) write(p []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.buf) >= f.limit() && !f.closed {
+		f.cond.Wait()
+	}
+	f.buf = append(f.buf, p...)
+	f.cond.Broadcast()
+}
+
+func (f *framer) close() {
+	f.mu.Lock()
+	f.closed = true
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// run sends frames from f.buf on f.ch, until f is closed
+// and drained.
+func (f *framer) run() {
+	defer close(f.ch)
+	for {
+		f.mu.Lock()
+		for len(f.buf) == 0 && !f.closed {
+			f.cond.Wait()
+		}
+		if len(f.buf) == 0 {
+			f.mu.Unlock()
+			return
+		}
+		n := min(len(f.buf), f.max)
+		frame := append([]byte(nil), f.buf[:n]...)
+		f.buf = append(f.buf[:0], f.buf[n:]...)
+		f.cond.Broadcast()
+		f.mu.Unlock()
+		f.ch <- frame
+	}
+}
+
+// frameTap is a reader that passes what it reads on to the
+// FrameChan framers.
+type frameTap struct {
+	r io.Reader
+	c *CaptureOuts
+}
+
+func (t *frameTap) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.c.mut.Lock()
+		framers := t.c.framers
+		t.c.mut.Unlock()
+		for _, f := range framers {
+			f.write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// closeFramers closes the FrameChan channels, once each has
+// sent what it holds; later ones are closed at once.
+func (c *CaptureOuts) closeFramers() {
+	c.mut.Lock()
+	framers := c.framers
+	c.framers = nil
+	c.framesClosed = true
+	c.mut.Unlock()
+	for _, f := range framers {
+		f.close()
+	}
+}
@@ -0,0 +1,66 @@
+package capture
+
+import (
+	"time"
+)
+
+// OnIdle registers fn to be called whenever the process has
+// produced no new line, on either stream, for d: for a UI to
+// show "still working...", or to escalate, without the
+// package deciding to kill anything. It is debounced: fn is
+// called once per quiet stretch, and not again until output
+// has resumed and then gone quiet for d once more. The idle
+// timer starts when the process does, and is reset by each
+// line stored. fn runs on a goroutine of its own, only while
+// the process runs. d <= 0 or a nil fn turns this off. Call
+// OnIdle before Exec.
+func (c *CaptureOuts) OnIdle(d time.Duration, fn func()) {
+	c.mut.Lock()
+	c.idleAfter = d
+	c.onIdle = fn
+	c.mut.Unlock()
+}
+
+// startIdleWatch starts the watchdog requested by OnIdle, if
+// any. The returned stop function ends it.
+func (c *CaptureOuts) startIdleWatch() (stop func()) {
+	c.mut.Lock()
+	d, fn := c.idleAfter, c.onIdle
+	c.lastLineAt = time.Now()
+	c.mut.Unlock()
+	if d <= 0 || fn == nil {
+		return func() {}
+	}
+	halt := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		var fired time.Time // lastLineAt when fn was last called.
+		for {
+			select {
+			case <-timer.C:
+			case <-halt:
+				return
+			}
+			c.mut.Lock()
+			last := c.lastLineAt
+			c.mut.Unlock()
+			quiet := time.Since(last)
+			if quiet < d {
+				timer.Reset(d - quiet)
+				continue
+			}
+			if !last.Equal(fired) {
+				fired = last
+				c.safely("OnIdle callback", fn)
+			}
+			timer.Reset(d)
+		}
+	}()
+	return func() {
+		close(halt)
+		<-done
+	}
+}
@@ -0,0 +1,83 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// JSONEvent is a stdout line decoded by JSONLines.
+type JSONEvent struct {
+	// Value is a pointer to a new value of the prototype's
+	// type, holding the decoded line; nil if Err is set.
+	Value any
+
+	// Line is the line as captured.
+	Line string
+
+	// Err is set if Line could not be decoded, or, with
+	// Line empty, if JSONLines could not subscribe.
+	Err error
+}
+
+// JSONLines is for processes that log newline delimited JSON
+// on stdout. It returns a channel on which each stdout line
+// captured from now on is delivered, in order, unmarshalled
+// into a new value of the type of proto: with proto a T or a
+// *T, each Value is a *T. A line that does not decode is
+// delivered too, with its content and the error, rather than
+// dropped; blank lines are skipped. The channel is closed
+// once capture is complete, or once the returned cancel func
+// is called. It is fed by Subscribe, so call JSONLines before
+// Exec to see every line, and keep reading until the channel
+// is closed, or capture is held up. If the subscription fails,
+// at the SetMaxSubscribers limit, the channel delivers one
+// event with only Err set, and is closed.
+func (c *CaptureOuts) JSONLines(proto any) (<-chan JSONEvent, func()) {
+	t := reflect.TypeOf(proto)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	lines, unsub, err := c.subscribe()
+	out := make(chan JSONEvent, subscribeBuffer)
+	if err != nil {
+		out <- JSONEvent{Err: fmt.Errorf("error in CaptureOuts.JSONLines(): %w", err)}
+		close(out)
+		return out, func() {}
+	}
+	quit := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(quit)
+			unsub()
+		})
+	}
+	go func() {
+		defer close(out)
+		for ln := range lines {
+			if !ln.Stream.isStdout() || strings.TrimSpace(ln.Text) == "" {
+				continue
+			}
+			ev := JSONEvent{Line: ln.Text}
+			if t == nil {
+				ev.Err = fmt.Errorf("error in CaptureOuts.JSONLines(): nil prototype")
+			} else {
+				v := reflect.New(t)
+				if err := json.Unmarshal([]byte(ln.Text), v.Interface()); err != nil {
+					ev.Err = fmt.Errorf("error in CaptureOuts.JSONLines(): decoding %q: %w", ln.Text, err)
+				} else {
+					ev.Value = v.Interface()
+				}
+			}
+			select {
+			case out <- ev:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return out, cancel
+}
@@ -0,0 +1,487 @@
+package capture
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Line is a single captured line, along with
+// the stream it came from.
+type Line struct {
+	Text     string
+	IsStdErr bool
+	Stream   Stream
+
+	// Time is when the line was captured, if
+	// SetTimestamps(true) was in effect; otherwise zero.
+	Time time.Time
+
+	// Stage is the index of the command that produced
+	// the line, in ExecPipeline; otherwise zero.
+	Stage int
+
+	// Count is the number of times the line was captured in
+	// a row, as collapsed by SetCollapseRepeats; otherwise 1.
+	Count int
+
+	// Binary is true if the line is not valid UTF-8, and
+	// SetRequireUTF8(false) is in effect.
+	Binary bool
+
+	// Source is the index of the capture the line came from,
+	// in MergeCaptures; otherwise zero.
+	Source int
+}
+
+// SetTimestamps(true) records the time at which each line is
+// captured, made available in the Time field of the Lines
+// returned by, e.g., GroupedByStream and LinesSinceTime. It
+// costs a time.Time per line. Call it before Exec; lines
+// captured before timestamps were enabled get a zero Time.
+func (c *CaptureOuts) SetTimestamps(on bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.timestamps = on
+	if on {
+		for len(c.times) < len(c.lines) {
+			c.times = append(c.times, time.Time{})
+		}
+	}
+}
+
+// lineAt returns the i-th stored line as a Line.
+// The caller must hold c.mut.
+func (c *CaptureOuts) lineAt(i int) Line {
+	ln := Line{Text: c.lines[i], IsStdErr: c.streams[i] == Stderr, Stream: c.streams[i]}
+	if i < len(c.times) {
+		ln.Time = c.times[i]
+	}
+	if i < len(c.stages) {
+		ln.Stage = c.stages[i]
+	}
+	ln.Count = c.repeats(i)
+	ln.Binary = c.isBinary(ln.Text)
+	return ln
+}
+
+// SetCollapseRepeats(true) stores a run of identical lines,
+// from the same stream, as a single line with a repeat count,
+// for chatty processes that print "retrying..." thousands of
+// times. GetComboOutSoFar, BytesSoFar, Output, Snapshot,
+// StdoutReader, LineRunes and the file dumps expand the
+// repeats again, while CollapsedLines gives the lines with
+// their counts. The other accessors, such as Page, Stats and
+// Contains, see each run as one line. Tee writers, sinks, subscribers and
+// StreamNDJSON still get every line, each with its own seq.
+// Call it before Exec.
+func (c *CaptureOuts) SetCollapseRepeats(on bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.collapse = on
+	if on {
+		for len(c.counts) < len(c.lines) {
+			c.counts = append(c.counts, 1)
+		}
+	}
+}
+
+// CollapsedLines returns the lines captured so far, with
+// each run of repeats collapsed by SetCollapseRepeats as a
+// single Line, whose Count says how long the run was.
+func (c *CaptureOuts) CollapsedLines() []Line {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	res := make([]Line, len(c.lines))
+	for i := range res {
+		res[i] = c.lineAt(i)
+	}
+	return res
+}
+
+// SeedLines adds lines to the capture, as though they had
+// been captured, with isStdErr[i] saying whether lines[i]
+// came from stderr; before any process runs, or for a capture
+// that never runs one. This lets unit tests of code that
+// consumes a *CaptureOuts do without a real subprocess; see
+// also Replay. The lines are stored as they are, but for
+// SetTrimNewline, which applies. Being stored output, they
+// count towards the bytes allowed by SetCombinedMaxBytes and
+// SetTailBytes, just as captured lines do: lines captured
+// later may find the limit already reached, and SetTailBytes
+// may evict or cut short the seeded lines themselves. They
+// have no other side effects: they are not seen by tee
+// writers, sinks or subscribers, nor set off SetKillOnStderr
+// or the like. It returns an error, adding nothing, if the
+// two slices differ in length.
+func (c *CaptureOuts) SeedLines(lines []string, isStdErr []bool) error {
+	if len(lines) != len(isStdErr) {
+		return fmt.Errorf("error in CaptureOuts.SeedLines(): len(lines) = %v but len(isStdErr) = %v", len(lines), len(isStdErr))
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	var now time.Time
+	if c.timestamps {
+		now = time.Now()
+	}
+	for i, line := range lines {
+		a := Stdout
+		if isStdErr[i] {
+			a = Stderr
+		}
+		line = c.trimLine(line)
+		c.storeLine(line, a, 0, now)
+		c.sawStream[a] = true
+		c.storedBytes += int64(len(line))
+		c.lineSeq++
+		if c.tailBytes > 0 {
+			c.tailHeld += int64(len(line) + len(c.lineEnd()))
+			c.trimToTail()
+		}
+	}
+	if len(lines) > 0 && !c.sawOutput {
+		c.sawOutput = true
+		close(c.firstOutput)
+	}
+	if c.lineAdded != nil {
+		close(c.lineAdded)
+		c.lineAdded = nil
+	}
+	return nil
+}
+
+// LinesInByteRange returns the lines that overlap the byte
+// range [start, end) of the combined output, as BytesSoFar
+// would give it were no line ever evicted; so offsets stay
+// valid as the capture grows, or is trimmed by, say,
+// SetTailBytes, for a viewer that scrolls by byte position.
+// The offsets of the lines are kept as they are stored, so
+// this is a binary search. A line collapsed by
+// SetCollapseRepeats gives one entry for each of its repeats
+// that overlaps. Lines that have been evicted are left out.
+func (c *CaptureOuts) LinesInByteRange(start, end int64) (res []string) {
+	if end <= start {
+		return nil
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	size := int64(len(c.lineEnd()))
+	// the first line that ends after start.
+	first := sort.Search(len(c.offsets), func(i int) bool {
+		return c.lineEndOffset(i) > start
+	})
+	for i := first; i < len(c.lines) && c.offsets[i] < end; i++ {
+		n := int64(len(c.lines[i])) + size
+		for k := 0; k < c.repeats(i); k++ {
+			off := c.offsets[i] + int64(k)*n
+			if off < end && off+n > start {
+				res = append(res, c.lines[i])
+			}
+		}
+	}
+	return
+}
+
+// lineEndOffset returns the offset just past lines[i],
+// with all its repeats. The caller must hold c.mut.
+func (c *CaptureOuts) lineEndOffset(i int) int64 {
+	if i+1 < len(c.offsets) {
+		return c.offsets[i+1]
+	}
+	return c.nextOffset
+}
+
+// LinesSinceTime returns the lines captured at or after t;
+// for a UI showing, say, the output of the last 5 seconds.
+// It needs SetTimestamps(true), and otherwise returns nil.
+// The timestamps are in capture order, so we binary search
+// for the first line, making this cheap on large histories.
+func (c *CaptureOuts) LinesSinceTime(t time.Time) (res []Line) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if !c.timestamps {
+		return nil
+	}
+	first := sort.Search(len(c.times), func(i int) bool {
+		return !c.times[i].Before(t)
+	})
+	for i := first; i < len(c.lines); i++ {
+		res = append(res, c.lineAt(i))
+	}
+	return
+}
+
+// GroupedByStream returns the lines captured so far, grouped
+// into runs of consecutive lines from the same stream. Each
+// new run marks a switch between stdout and stderr. This is
+// often nicer to display than the fully interleaved lines of
+// GetComboOutSoFar, when the two streams rarely alternate.
+func (c *CaptureOuts) GroupedByStream() (runs [][]Line) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for i := range c.lines {
+		ln := c.lineAt(i)
+		if i == 0 || c.streams[i] != c.streams[i-1] {
+			runs = append(runs, []Line{ln})
+			continue
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], ln)
+	}
+	return
+}
+
+// stdoutLines returns a copy of the stdout lines captured so far.
+func (c *CaptureOuts) stdoutLines() (res []string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for i, line := range c.lines {
+		if c.streams[i].isStdout() {
+			res = append(res, line)
+		}
+	}
+	return
+}
+
+// GetStdoutSoFar returns a copy of the stdout lines captured
+// so far (in PTY mode, the merged lines), in order, with any
+// collapsed repeats expanded; stderr lines are left out.
+func (c *CaptureOuts) GetStdoutSoFar() (res []string) {
+	lines, streams := c.linesSoFar()
+	for i, line := range lines {
+		if streams[i].isStdout() {
+			res = append(res, line)
+		}
+	}
+	return
+}
+
+// DiffStdout compares the stdout lines captured by c and by
+// other, for golden testing. If they are identical, it returns
+// equal true and firstDiffLine -1. Otherwise firstDiffLine is
+// the 0-based index, counting stdout lines only, of the first
+// line that differs, or that is present in only one of them.
+// Each capture is read under its own lock, in turn, so it is
+// safe to diff two captures that are still running.
+func (c *CaptureOuts) DiffStdout(other *CaptureOuts) (equal bool, firstDiffLine int) {
+	a := c.stdoutLines()
+	b := other.stdoutLines()
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return false, i
+		}
+	}
+	if len(a) != len(b) {
+		return false, min(len(a), len(b))
+	}
+	return true, -1
+}
+
+// StdoutLineAt returns the n-th (0-based) line captured from
+// stdout, counting stdout lines only, and whether there is
+// such a line yet; for protocols that give meaning to line
+// positions on a single stream. It is computed from the
+// combined lines, under the lock.
+func (c *CaptureOuts) StdoutLineAt(n int) (string, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if n < 0 {
+		return "", false
+	}
+	for i, line := range c.lines {
+		if !c.streams[i].isStdout() {
+			continue
+		}
+		if n == 0 {
+			return line, true
+		}
+		n--
+	}
+	return "", false
+}
+
+// Page returns a window of the lines captured so far, from
+// either stream: up to limit lines starting at index offset,
+// with whether each is from stderr, and the total number of
+// lines stored; for "lines 1000-1050 of 50000" displays of
+// huge output, without copying the whole history. An offset
+// past the end gives no lines; a negative offset is taken as
+// 0, and a negative limit as no limit.
+func (c *CaptureOuts) Page(offset, limit int) (lines []string, isStdErr []bool, total int) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	total = len(c.lines)
+	offset = min(max(offset, 0), total)
+	end := total
+	if limit >= 0 && limit < total-offset {
+		end = offset + limit
+	}
+	lines = append([]string(nil), c.lines[offset:end]...)
+	isStdErr = make([]bool, len(lines))
+	for i := range isStdErr {
+		isStdErr[i] = c.streams[offset+i] == Stderr
+	}
+	return
+}
+
+// SplitAt returns copies of the lines captured so far, from
+// either stream, split at index: before holds those before
+// it, and after those from it on; for a pager rendering the
+// lines above and below its position. index is clamped to
+// [0, number of lines], so that a negative index puts every
+// line in after, and one past the end every line in before.
+// With nothing captured, both are empty.
+func (c *CaptureOuts) SplitAt(index int) (before, after []string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	index = min(max(index, 0), len(c.lines))
+	before = append([]string(nil), c.lines[:index]...)
+	after = append([]string(nil), c.lines[index:]...)
+	return
+}
+
+// LineRunes returns the runes of the index-th line captured
+// so far, from either stream, as in GetComboOutSoFar, and
+// whether there is such a line; for terminal UIs doing cursor
+// and column math. The line is decoded from UTF-8 on demand,
+// with any invalid bytes becoming utf8.RuneError. Under
+// SetCollapseRepeats, index counts each repeat, as
+// GetComboOutSoFar expands them.
+func (c *CaptureOuts) LineRunes(index int) ([]rune, bool) {
+	c.mut.Lock()
+	i := index
+	if len(c.counts) > 0 {
+		// find the stored line holding the index-th repeat.
+		for i = 0; i < len(c.lines) && index >= c.counts[i]; i++ {
+			index -= c.counts[i]
+		}
+	}
+	if index < 0 || i >= len(c.lines) {
+		c.mut.Unlock()
+		return nil, false
+	}
+	line := c.lines[i]
+	c.mut.Unlock()
+	return []rune(line), true
+}
+
+// CountMatching returns how many of the lines captured so far
+// match re; for quick metrics like "how many WARN lines so
+// far" during a long run. It scans under the lock without
+// copying the lines or allocating a result.
+func (c *CaptureOuts) CountMatching(re *regexp.Regexp) (n int) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, line := range c.lines {
+		if re.MatchString(line) {
+			n++
+		}
+	}
+	return
+}
+
+// Contains reports whether any line captured so far, from
+// either stream, contains substr; for quick assertions like
+// "did the log mention 'ready'?". It scans under the lock,
+// stopping at the first match, without copying the lines.
+func (c *CaptureOuts) Contains(substr string) bool {
+	return c.contains(substr, false)
+}
+
+// ContainsStderr is like Contains, but looks only at the
+// lines from stderr.
+func (c *CaptureOuts) ContainsStderr(substr string) bool {
+	return c.contains(substr, true)
+}
+
+func (c *CaptureOuts) contains(substr string, stderrOnly bool) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for i, line := range c.lines {
+		if stderrOnly && c.streams[i] != Stderr {
+			continue
+		}
+		if strings.Contains(line, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TailAroundLastStderr returns the last stderr line captured
+// so far, along with up to n lines of context on either side
+// of it, from both streams, in order; for a crash report that
+// wants the error and what surrounded it, rather than the
+// whole log. It returns nil if there has been no stderr.
+func (c *CaptureOuts) TailAroundLastStderr(n int) []string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	last := -1
+	for i := len(c.streams) - 1; i >= 0; i-- {
+		if c.streams[i] == Stderr {
+			last = i
+			break
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	from := max(0, last-n)
+	to := min(len(c.lines), last+n+1)
+	return append([]string(nil), c.lines[from:to]...)
+}
+
+// LastLine returns the most recently stored line, and whether
+// it came from stderr; ok is false if nothing has been
+// captured yet. For progress monitors showing the current
+// status line.
+func (c *CaptureOuts) LastLine() (line string, isStdErr bool, ok bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	n := len(c.lines)
+	if n == 0 {
+		return "", false, false
+	}
+	return c.lines[n-1], c.streams[n-1] == Stderr, true
+}
+
+// Canonical returns the combined output in a normal form, for
+// comparing against a golden file in tests that must pass on
+// every OS. It is made from the lines, in capture order, with
+// collapsed repeats expanded, and nothing sorted, by applying
+// exactly these normalizations:
+//
+//   - each line's terminator (the delimiter, see SetDelimiter,
+//     with any '\r' just before it, as in the "\r\n" of
+//     Windows tools and of PTY mode) is replaced by a single
+//     '\n', and a final unterminated line gets one too;
+//   - stderr lines are prefixed with "stderr: ", and SetStdinTee
+//     lines with "stdin: "; stdout (and PTY mode's merged)
+//     lines, and ExecSequence's markers, get no prefix.
+//
+// Nothing else, such as trailing spaces or the bytes within a
+// line, is changed.
+func (c *CaptureOuts) Canonical() string {
+	lines, streams := c.linesSoFar()
+	c.mut.Lock()
+	delim := string(c.delim)
+	c.mut.Unlock()
+	var b strings.Builder
+	for i, line := range lines {
+		switch streams[i] {
+		case Stderr:
+			b.WriteString("stderr: ")
+		case Stdin:
+			b.WriteString("stdin: ")
+		}
+		line = strings.TrimSuffix(line, delim)
+		line = strings.TrimSuffix(line, "\r")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
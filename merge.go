@@ -0,0 +1,42 @@
+package capture
+
+import (
+	"slices"
+)
+
+// MergeCaptures returns the lines of all of caps merged into
+// one timeline, for showing the output of several concurrent
+// jobs as a single interleaved log. Each Line's Source is the
+// index in caps of the capture it came from. Captures made
+// with SetTimestamps(true) are merged in order of their
+// lines' Times, ties going to the lower Source; a capture
+// without timestamps can't be placed in that order, so its
+// lines follow all of those, in the order they were captured,
+// one capture after another. Either way, each capture's own
+// lines keep their order. Collapsed repeats (see
+// SetCollapseRepeats) stay collapsed, as in CollapsedLines.
+// The captures may still be running; MergeCaptures sees what
+// each has captured so far.
+func MergeCaptures(caps ...*CaptureOuts) []Line {
+	var timed, untimed []Line
+	for src, c := range caps {
+		c.mut.Lock()
+		to := &untimed
+		if c.timestamps {
+			to = &timed
+		}
+		for i := range c.lines {
+			ln := c.lineAt(i)
+			ln.Source = src
+			*to = append(*to, ln)
+		}
+		c.mut.Unlock()
+	}
+	// stable, so ties keep their Source order, and each
+	// capture's lines, whose Times never go backwards, their
+	// own order.
+	slices.SortStableFunc(timed, func(a, b Line) int {
+		return a.Time.Compare(b.Time)
+	})
+	return append(timed, untimed...)
+}
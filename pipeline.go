@@ -0,0 +1,182 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExecPipeline runs the equivalent of the shell pipeline
+// "a | b | c", without a shell: each element of cmds is a
+// command and its arguments, and the stdout of each command
+// is connected directly to the stdin of the next, through an
+// OS pipe. We capture the stdout of the last command, and the
+// stderr of every command. Each stored Line records in its
+// Stage field the index in cmds of the command that produced
+// it, so stderr can be attributed to the right stage. Any
+// SetStdin reader feeds the first command.
+//
+// Like Exec, ExecPipeline blocks until every command has
+// finished, and then sets c.Err and closes c.Done. As with
+// the shell's pipefail option, c.Err reports every command
+// that failed, identified by its stage index. The exit code
+// and pid reported by Snapshot and Describe are those of the
+// last command. PTY mode and SetUmask are not applied to
+// pipelines.
+func (c *CaptureOuts) ExecPipeline(cmds ...[]string) error {
+	return c.finish(c.execPipeline(cmds))
+}
+
+func (c *CaptureOuts) execPipeline(cmds [][]string) error {
+	if len(cmds) == 0 {
+		return fmt.Errorf("error in CaptureOuts.ExecPipeline(): %w with 'no commands given'", ErrStartFailed)
+	}
+	procs := make([]*exec.Cmd, len(cmds))
+	var descs []string
+	for i, args := range cmds {
+		if len(args) == 0 {
+			return fmt.Errorf("error in CaptureOuts.ExecPipeline(): %w with 'stage %v is an empty command'", ErrStartFailed, i)
+		}
+		procs[i] = c.execCommand(context.Background(), args[0], args[1:]...)
+		descs = append(descs, strings.Join(args, " "))
+	}
+	last := procs[len(procs)-1]
+	c.mut.Lock()
+	c.cmd = last
+	c.cmdLine = strings.Join(descs, " | ")
+	c.pid = 0
+	c.pipeline = true
+	c.procs = nil
+	c.mut.Unlock()
+	c.startSlogger(filepath.Base(last.Path))
+	defer c.stopSlogger()
+	stopFlusher := c.startTeeFlusher()
+	defer stopFlusher()
+	stopPruner := c.startRetainPruner()
+	defer stopPruner()
+	stopIdle := c.startIdleWatch()
+	defer stopIdle()
+
+	stdinDone := c.setupStdin(procs[0])
+
+	// connect each stage's stdout to the next stage's stdin.
+	// We close our copies of the pipe ends once the stages
+	// holding them have started, so that an early exit by a
+	// reader gives its writer SIGPIPE, and an exit by a writer
+	// gives its reader EOF, just as in the shell.
+	var ours []*os.File
+	closeOurs := func() {
+		for _, f := range ours {
+			f.Close()
+		}
+		ours = nil
+	}
+	for i := 0; i < len(procs)-1; i++ {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			closeOurs()
+			stdinDone()
+			return stageError("start", err, fmt.Errorf("error in CaptureOuts.ExecPipeline(): %w with '%w'", ErrStartFailed, err))
+		}
+		procs[i].Stdout = pw
+		procs[i+1].Stdin = pr
+		ours = append(ours, pr, pw)
+	}
+	var fromLastStdout io.Reader
+	passthrough := c.passthroughWriter()
+	if passthrough != nil {
+		last.Stdout = passthrough
+	}
+
+	// hold stderr open, for OnStderrEOF, until every stage's
+	// stderr capture has begun.
+	c.mut.Lock()
+	c.eofOpen[Stderr]++
+	c.mut.Unlock()
+
+	var started []*exec.Cmd
+	var pipes []io.Reader
+	for i, p := range procs {
+		// each stage's pipes are made just before it starts:
+		// exec only closes them in Start or Wait, so those of
+		// stages after one that failed to start would leak.
+		stderr, _ := p.StderrPipe()
+		pipes = append(pipes, stderr)
+		if p == last && passthrough == nil {
+			fromLastStdout, _ = last.StdoutPipe()
+			pipes = append(pipes, fromLastStdout)
+		}
+		c.setPipes(pipes...)
+		err := p.Start()
+		if err != nil {
+			// tear down the stages already running.
+			c.streamEOF(Stderr)
+			closeOurs()
+			for _, s := range started {
+				s.Process.Kill()
+			}
+			c.wg.Wait()
+			for _, s := range started {
+				s.Wait()
+			}
+			stdinDone()
+			return stageError("start", err, fmt.Errorf("error in CaptureOuts.ExecPipeline(): stage %v (%s): %w with '%w'", i, descs[i], ErrStartFailed, err))
+		}
+		started = append(started, p)
+		c.mut.Lock()
+		c.procs = started
+		c.mut.Unlock()
+		c.captureWG(stderr, Stderr, i, &c.wg)
+	}
+	c.streamEOF(Stderr)
+	closeOurs()
+	if c.stderrKillErr() != nil {
+		// an early stage's stderr killed those started before.
+		c.killProcs()
+	}
+	if fromLastStdout != nil {
+		c.captureWG(fromLastStdout, Stdout, len(procs)-1, &c.wg)
+	}
+
+	c.mut.Lock()
+	c.running = true
+	c.pid = last.Process.Pid
+	c.startTime = time.Now()
+	c.markStarted()
+	c.mut.Unlock()
+	ctx, stopCancel := c.withCancelChan(context.Background())
+	defer stopCancel()
+
+	c.wg.Wait()
+	var errs []error
+	for i, p := range procs {
+		err := p.Wait()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stage %v (%s): %w with err='%w'", i, descs[i], ErrWaitFailed, err))
+		}
+	}
+	stdinDone()
+	c.mut.Lock()
+	c.running = false
+	c.mut.Unlock()
+	if readErr := c.readError(); readErr != nil {
+		errs = append(errs, fmt.Errorf("%w with '%w'", ErrReadFailed, readErr))
+	}
+	if serr := c.stderrKillErr(); serr != nil {
+		errs = append([]error{serr}, errs...)
+	}
+	if ctx.Err() != nil {
+		errs = append([]error{fmt.Errorf("context done with '%w'", ctx.Err())}, errs...)
+	}
+	if len(errs) > 0 {
+		joined := errors.Join(errs...)
+		return stageError("pipeline", joined, fmt.Errorf("error in CaptureOuts.ExecPipeline(): %w", joined))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package capture
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Pool runs many captures while limiting how many of them
+// are running at once; the rest wait their turn, in no
+// particular order.
+type Pool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+// NewPool returns a Pool that runs at most maxConcurrent
+// processes at a time. maxConcurrent < 1 is taken as 1.
+func NewPool(maxConcurrent int) *Pool {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &Pool{sem: make(chan struct{}, maxConcurrent)}
+}
+
+// Run queues the command arg0 args... and returns without
+// waiting, giving back the CaptureOuts that will capture its
+// output. It is Exec'd once one of the pool's slots is free;
+// until then it is not running, and c.Done is closed when it
+// completes, with any failure in c.Err. The only error
+// returned by Run itself is for an empty command.
+func (p *Pool) Run(arg0 string, args ...string) (*CaptureOuts, error) {
+	if arg0 == "" {
+		return nil, fmt.Errorf("error in Pool.Run(): empty command")
+	}
+	c := NewCaptureOuts()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.sem <- struct{}{}
+		defer func() { <-p.sem }()
+		c.Exec(arg0, args...)
+	}()
+	return c, nil
+}
+
+// Wait blocks until everything queued by Run has completed.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+// Go schedules c.Exec(arg0, args...) on g, which is usually
+// an *errgroup.Group from golang.org/x/sync/errgroup, so that
+// the command's error takes part in the group's error
+// handling, and g.Wait() waits for it. Only g's Go method is
+// needed, so we don't depend on errgroup. For example:
+//
+//	var g errgroup.Group
+//	build, vet := capture.NewCaptureOuts(), capture.NewCaptureOuts()
+//	build.Go(&g, "go", "build", "./...")
+//	vet.Go(&g, "go", "vet", "./...")
+//	err := g.Wait()
+//
+// Go doesn't wait; with a limited group (see errgroup's
+// SetLimit), it may block until g has room. Note that an
+// errgroup.WithContext's context is not passed on; to have a
+// failure kill the other commands, use ExecContext in a
+// closure of your own.
+func (c *CaptureOuts) Go(g interface{ Go(func() error) }, arg0 string, args ...string) {
+	g.Go(func() error {
+		return c.Exec(arg0, args...)
+	})
+}
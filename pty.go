@@ -0,0 +1,104 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/creack/pty"
+)
+
+// SetPTY(true) arranges for Exec to connect the child's stdin,
+// stdout and stderr to a pseudo-terminal, rather than to pipes,
+// so the child behaves as if run from a real terminal: isatty()
+// checks succeed, colors are kept, and output is typically
+// line buffered rather than block buffered. We capture by
+// reading from the PTY master. The child also runs in a new
+// session, with the PTY as its controlling terminal.
+//
+// Just as on a real terminal, stdout and stderr are merged in
+// PTY mode, so all lines are tagged with the Merged stream,
+// and the isStdErr slice from GetComboOutSoFar(true) will
+// always be all false. Accessors that return stdout only,
+// such as Output, include the Merged lines. Note too that the
+// terminal's line discipline translates each "\n" the child
+// writes into "\r\n".
+//
+// PTY mode is supported on Unix-like systems only; on Windows,
+// Exec will fail to start the child. Call SetPTY before Exec.
+func (c *CaptureOuts) SetPTY(usePTY bool) {
+	c.usePTY = usePTY
+}
+
+// SetPTYSize sets the initial window size of the PTY used in
+// PTY mode (see SetPTY). Without it, the size is left to the
+// system default, typically 80x24 or even 0x0, and full-screen
+// programs and progress bars may render wrongly. Call
+// SetPTYSize before Exec.
+func (c *CaptureOuts) SetPTYSize(rows, cols uint16) {
+	c.mut.Lock()
+	c.ptySize = &pty.Winsize{Rows: rows, Cols: cols}
+	c.mut.Unlock()
+}
+
+// ResizePTY changes the window size of the PTY while the child
+// is running in PTY mode. The kernel then sends SIGWINCH to the
+// terminal's foreground process group, so the child can redraw.
+// ResizePTY returns an error if there is no running PTY.
+func (c *CaptureOuts) ResizePTY(rows, cols uint16) error {
+	c.mut.Lock()
+	ptmx := c.ptmx
+	c.ptySize = &pty.Winsize{Rows: rows, Cols: cols}
+	ws := *c.ptySize
+	c.mut.Unlock()
+
+	if ptmx == nil {
+		return fmt.Errorf("error in CaptureOuts.ResizePTY(): no PTY; call SetPTY(true) before Exec")
+	}
+	err := pty.Setsize(ptmx, &ws)
+	if err != nil {
+		return fmt.Errorf("error in CaptureOuts.ResizePTY(): '%v'", err)
+	}
+	return nil
+}
+
+// startPTY starts cmd attached to a new PTY, and begins
+// capturing from the PTY master.
+func (c *CaptureOuts) startPTY(cmd *exec.Cmd) error {
+	c.mut.Lock()
+	size := c.ptySize
+	c.mut.Unlock()
+
+	var ptmx *os.File
+	err := c.withUmask(func() (err error) {
+		ptmx, err = pty.StartWithSize(cmd, size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.mut.Lock()
+	c.ptmx = ptmx
+	c.mut.Unlock()
+	c.setPipes(ptmx)
+	c.capture(ptyReader{ptmx}, Merged)
+	return nil
+}
+
+// ptyReader reports io.EOF rather than the EIO which
+// Linux gives on reading from a PTY master once the
+// last process holding the terminal has closed it.
+type ptyReader struct {
+	r io.Reader
+}
+
+func (p ptyReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,73 @@
+package capture
+
+import (
+	"io"
+)
+
+// StdoutReader returns an io.Reader that yields the captured
+// stdout, line by line in order, starting from the first
+// line, and blocks for more until c.Done is closed, after
+// which it returns io.EOF once everything has been read.
+// Stderr (and any Stdin lines) are left out, so stdout can
+// be piped into a parser or another process while stderr is
+// handled separately. Each reader keeps its own position, and
+// is safe to use alongside the capture goroutines, though a
+// single reader is not safe for concurrent Reads. Lines
+// evicted before they are read, as by SetTailBytes, are
+// skipped.
+func (c *CaptureOuts) StdoutReader() io.Reader {
+	return &stdoutReader{c: c}
+}
+
+type stdoutReader struct {
+	c    *CaptureOuts
+	next int // seq of the next line to look at.
+	done int // repeats of that line already read.
+	buf  []byte
+}
+
+func (r *stdoutReader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		c := r.c
+		c.mut.Lock()
+		// check before scanning: once Done is closed, no more
+		// lines will come, so a scan that finds none means EOF.
+		done := c.isDone()
+		i := r.next - c.droppedLines
+		if i < 0 {
+			i, r.done = 0, 0
+		}
+		// a line stays the next one until all its repeats,
+		// which may still be growing, have been read.
+		for ; i < len(c.lines); i, r.done = i+1, 0 {
+			if c.streams[i].isStdout() && r.done < c.repeats(i) {
+				r.buf = append(r.buf[:0], c.lines[i]...)
+				r.buf = append(r.buf, c.lineEnd()...)
+				r.done++
+				break
+			}
+		}
+		r.next = c.droppedLines + i
+		if len(r.buf) > 0 {
+			c.mut.Unlock()
+			break
+		}
+		if done {
+			c.mut.Unlock()
+			return 0, io.EOF
+		}
+		if c.lineAdded == nil {
+			c.lineAdded = make(chan struct{})
+		}
+		wait := c.lineAdded
+		c.mut.Unlock()
+
+		select {
+		case <-wait:
+		case <-c.Done:
+		}
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,74 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WaitForListenPort waits for a line, from either stream,
+// that matches re, whose first capture group holds a port
+// number, and returns that port; for a test server started
+// with ":0" that prints "listening on :PORT" once it is
+// ready. Lines already captured are looked at first, so it
+// may be called before or after Exec starts. re is matched
+// against each line without its trailing delimiter. For
+// example:
+//
+//	go c.Exec("./server", "-addr", ":0")
+//	port, err := c.WaitForListenPort(ctx, regexp.MustCompile(`listening on .*:(\d+)`))
+//
+// It returns an error at once if re has no capture group,
+// and if the first matching line's group is not a port
+// number; and also if ctx is done (the error wraps
+// ctx.Err()), or if the process finishes, before any line
+// matches.
+func (c *CaptureOuts) WaitForListenPort(ctx context.Context, re *regexp.Regexp) (int, error) {
+	if re.NumSubexp() == 0 {
+		return 0, fmt.Errorf("error in CaptureOuts.WaitForListenPort(): regexp `%v` has no capture group for the port", re)
+	}
+	next := 0 // seq of the next line to look at.
+	for {
+		c.mut.Lock()
+		// check before scanning: once Done is closed, no more
+		// lines will come.
+		done := c.isDone()
+		i := next - c.droppedLines
+		if i < 0 {
+			i = 0
+		}
+		for ; i < len(c.lines); i++ {
+			line := strings.TrimSuffix(c.lines[i], string(c.delim))
+			m := re.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			c.mut.Unlock()
+			port, err := strconv.Atoi(m[1])
+			if err != nil || port < 0 || port > 65535 {
+				return 0, fmt.Errorf("error in CaptureOuts.WaitForListenPort(): line '%v' matched, but its group '%v' is not a port number", line, m[1])
+			}
+			return port, nil
+		}
+		next = c.droppedLines + i
+		if done {
+			c.mut.Unlock()
+			return 0, errors.New("error in CaptureOuts.WaitForListenPort(): the process finished before any line matched")
+		}
+		if c.lineAdded == nil {
+			c.lineAdded = make(chan struct{})
+		}
+		wait := c.lineAdded
+		c.mut.Unlock()
+
+		select {
+		case <-wait:
+		case <-c.Done:
+		case <-ctx.Done():
+			return 0, fmt.Errorf("error in CaptureOuts.WaitForListenPort(): no line matched: %w", ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// recordHeader is the first JSON object written by Record.
+type recordHeader struct {
+	Record      int    `json:"record"` // format version.
+	Command     string `json:"command,omitempty"`
+	ExitCode    int    `json:"exit_code"`
+	Err         string `json:"err,omitempty"`
+	Delim       byte   `json:"delim"`
+	TrimNewline bool   `json:"trim_newline,omitempty"`
+	Lines       int    `json:"lines"`
+}
+
+// recordLine is each following JSON object written by Record.
+type recordLine struct {
+	Stream string     `json:"stream"`
+	Text   string     `json:"text"`
+	Time   *time.Time `json:"time,omitempty"`
+	Stage  int        `json:"stage,omitempty"`
+	Count  int        `json:"count,omitempty"` // if over 1.
+}
+
+// Record writes the lines captured so far to w, with the
+// stream each came from, and its capture time and pipeline
+// stage when those were recorded, along with the command, exit
+// code and error; in a form that Replay reads back. The format
+// is newline delimited JSON: a header object and then one
+// object per line, in order. Call it after c.Done is closed
+// to record the whole session; a recording taken earlier is
+// of a capture still in progress.
+func (c *CaptureOuts) Record(w io.Writer) error {
+	c.mut.Lock()
+	h := recordHeader{
+		Record:      1,
+		Command:     c.cmdLine,
+		ExitCode:    c.exitCode,
+		Delim:       c.delim,
+		TrimNewline: c.trimNewline,
+		Lines:       len(c.lines),
+	}
+	if c.isDone() && c.Err != nil {
+		h.Err = c.Err.Error()
+	}
+	lines := make([]recordLine, len(c.lines))
+	for i := range lines {
+		ln := c.lineAt(i)
+		lines[i] = recordLine{Stream: ln.Stream.String(), Text: ln.Text, Stage: ln.Stage}
+		if ln.Count > 1 {
+			lines[i].Count = ln.Count
+		}
+		if !ln.Time.IsZero() {
+			lines[i].Time = &ln.Time
+		}
+	}
+	c.mut.Unlock()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(h); err != nil {
+		return fmt.Errorf("error in CaptureOuts.Record(): %w", err)
+	}
+	for i := range lines {
+		if err := enc.Encode(lines[i]); err != nil {
+			return fmt.Errorf("error in CaptureOuts.Record(): %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error in CaptureOuts.Record(): %w", err)
+	}
+	return nil
+}
+
+// Replay reads a session written by Record, and returns a
+// CaptureOuts holding the recorded lines, exit code and error,
+// already complete: c.Done is closed, and no process is run.
+// Line timestamps, if recorded, are restored, so the gaps
+// between lines are preserved for LinesSinceTime and the
+// like; see ReplayRealtime to have them play out again. This
+// lets a real run, captured once, serve as a fast test
+// fixture for code that consumes a CaptureOuts.
+func Replay(r io.Reader) (*CaptureOuts, error) {
+	c := NewCaptureOuts()
+	h, lines, err := readRecording(r, "Replay")
+	if err != nil {
+		return nil, err
+	}
+	c.replayHeader(h)
+	c.restore(lines)
+	return c, nil
+}
+
+// restore stores lines in a new c, and marks it complete,
+// for Replay and ReadTranscript.
+func (c *CaptureOuts) restore(lines []recordLine) {
+	for i := range lines {
+		ln := &lines[i]
+		a := parseStream(ln.Stream)
+		c.lines = append(c.lines, ln.Text)
+		c.streams = append(c.streams, a)
+		c.sawStream[a] = true
+		c.offsets = append(c.offsets, c.nextOffset)
+		c.nextOffset += int64(len(ln.Text)+len(c.lineEnd())) * int64(max(ln.Count, 1))
+		c.stages = append(c.stages, ln.Stage)
+		var tm time.Time
+		if ln.Time != nil {
+			tm = *ln.Time
+			c.timestamps = true
+		}
+		c.times = append(c.times, tm)
+		c.counts = append(c.counts, max(ln.Count, 1))
+		c.collapse = c.collapse || ln.Count > 1
+		c.storedBytes += int64(len(ln.Text))
+		c.lineSeq += max(ln.Count, 1)
+	}
+	if !c.timestamps {
+		c.times = nil
+	}
+	if !c.collapse {
+		c.counts = nil
+	}
+	if len(c.lines) > 0 {
+		c.sawOutput = true
+		close(c.firstOutput)
+	}
+	c.subsClosed = true
+	close(c.Done)
+}
+
+// ReplayRealtime is like Replay, but returns at once, with
+// the recorded lines then added in the background as if they
+// were being captured live, each after the same delay since
+// the previous one as when recorded (so only recordings made
+// with SetTimestamps(true) play out over time). c.Done is
+// closed after the last line. For testing code that watches
+// a capture in progress.
+func ReplayRealtime(r io.Reader) (*CaptureOuts, error) {
+	c := NewCaptureOuts()
+	h, lines, err := readRecording(r, "ReplayRealtime")
+	if err != nil {
+		return nil, err
+	}
+	c.replayHeader(h)
+	exitCode, cerr := c.exitCode, c.Err
+	c.exitCode, c.Err = -1, nil
+	c.running = true
+	for i := range lines {
+		c.pipeline = c.pipeline || lines[i].Stage != 0
+		c.timestamps = c.timestamps || lines[i].Time != nil
+		c.collapse = c.collapse || lines[i].Count > 1
+	}
+	go func() {
+		var prev time.Time
+		for i := range lines {
+			ln := &lines[i]
+			if ln.Time != nil {
+				if !prev.IsZero() && ln.Time.After(prev) {
+					time.Sleep(ln.Time.Sub(prev))
+				}
+				prev = *ln.Time
+			}
+			for k := max(ln.Count, 1); k > 0; k-- {
+				c.addLine(ln.Text, parseStream(ln.Stream), ln.Stage)
+			}
+		}
+		c.mut.Lock()
+		c.exitCode = exitCode
+		c.mut.Unlock()
+		c.finish(cerr)
+	}()
+	return c, nil
+}
+
+// replayHeader restores what h records, on a new c.
+func (c *CaptureOuts) replayHeader(h recordHeader) {
+	c.cmdLine = h.Command
+	c.exitCode = h.ExitCode
+	c.delim = h.Delim
+	c.trimNewline = h.TrimNewline
+	if h.Err != "" {
+		c.Err = errors.New(h.Err)
+	}
+}
+
+// readRecording parses a session written by Record. who
+// names the calling function, for error messages.
+func readRecording(r io.Reader, who string) (h recordHeader, lines []recordLine, err error) {
+	dec := json.NewDecoder(r)
+	if err = dec.Decode(&h); err != nil {
+		return h, nil, fmt.Errorf("error in %v(): reading header: %w", who, err)
+	}
+	if h.Record != 1 {
+		return h, nil, fmt.Errorf("error in %v(): not a recording, or unknown version %v", who, h.Record)
+	}
+	lines = make([]recordLine, 0, h.Lines)
+	for {
+		var ln recordLine
+		err = dec.Decode(&ln)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return h, nil, fmt.Errorf("error in %v(): reading line %v: %w", who, len(lines), err)
+		}
+		lines = append(lines, ln)
+	}
+	if len(lines) != h.Lines {
+		return h, nil, fmt.Errorf("error in %v(): recording truncated: got %v of %v lines", who, len(lines), h.Lines)
+	}
+	return h, lines, nil
+}
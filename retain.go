@@ -0,0 +1,75 @@
+package capture
+
+import (
+	"time"
+)
+
+// SetRetainDuration arranges for only the lines captured in
+// the last d to be kept, for a long running "rolling window"
+// tail view: while the process runs, a background ticker
+// evicts older lines, so memory holds only recent output. It
+// turns on SetTimestamps(true), which it relies on. As with
+// SetTailBytes, evicted lines shift the indices of those that
+// remain: an index into GetComboOutSoFar, say, or from
+// LinesSinceTime, should be adjusted by the change in
+// DroppedLines(). d <= 0, the default, keeps everything.
+// Call it before Exec.
+func (c *CaptureOuts) SetRetainDuration(d time.Duration) {
+	if d > 0 {
+		c.SetTimestamps(true)
+	}
+	c.mut.Lock()
+	c.retain = d
+	c.mut.Unlock()
+}
+
+// DroppedLines returns how many of the lines captured so far
+// have since been evicted from the front of the stored lines,
+// as by SetRetainDuration or SetTailBytes. Adding it to an
+// index into the current lines gives a stable position.
+func (c *CaptureOuts) DroppedLines() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.droppedLines
+}
+
+// pruneOld evicts the lines captured before cutoff.
+func (c *CaptureOuts) pruneOld(cutoff time.Time) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for len(c.times) > 0 && c.times[0].Before(cutoff) {
+		c.evictOldest()
+	}
+}
+
+// startRetainPruner starts the periodic eviction requested by
+// SetRetainDuration, if any. The returned stop function
+// ends it.
+func (c *CaptureOuts) startRetainPruner() (stop func()) {
+	c.mut.Lock()
+	d := c.retain
+	c.mut.Unlock()
+	if d <= 0 {
+		return func() {}
+	}
+	every := max(d/8, 10*time.Millisecond)
+	halt := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(every)
+		defer tick.Stop()
+		for {
+			select {
+			case now := <-tick.C:
+				c.pruneOld(now.Add(-d))
+			case <-halt:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(halt)
+		<-done
+	}
+}
@@ -0,0 +1,115 @@
+package capture
+
+import (
+	"fmt"
+	"os"
+)
+
+// SetRotatingFile arranges for the combined output to also
+// be written, line by line as captured, to the file at path,
+// which is rotated by size: once writing the next line would
+// take it past maxBytes, path is renamed to path.1 (and any
+// path.1 to path.2, and so on) and a fresh path is started.
+// At most keep old files are kept; older ones are removed. So
+// a long running daemon's capture log never takes more than
+// about (keep+1)*maxBytes of disk. Writes are in the same
+// order as the tee writes, and their errors are reported by
+// TeeErr(). The file is closed once capture completes. An
+// empty path turns this off. Call it before Exec.
+func (c *CaptureOuts) SetRotatingFile(path string, maxBytes int64, keep int) {
+	var r *rotatingFile
+	if path != "" {
+		r = &rotatingFile{path: path, maxBytes: maxBytes, keep: keep}
+	}
+	c.mut.Lock()
+	c.rotating = r
+	c.mut.Unlock()
+}
+
+// rotatingFile writes to path, rotating it by size.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	f    *os.File
+	size int64
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.f != nil && r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// open opens r.path for appending, noting its current size.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// rotate closes the current file and shifts it and the old
+// files along, path to path.1 and so on, dropping the oldest.
+// The next Write opens a new path.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	r.size = 0
+	if err != nil {
+		return err
+	}
+	if r.keep <= 0 {
+		return os.Remove(r.path)
+	}
+	os.Remove(fmt.Sprintf("%v.%v", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%v", r.path, i), fmt.Sprintf("%v.%v", r.path, i+1))
+	}
+	return os.Rename(r.path, r.path+".1")
+}
+
+// Close closes the current file, if one is open.
+func (r *rotatingFile) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// closeRotating closes the file of SetRotatingFile, if any,
+// once capture is complete.
+func (c *CaptureOuts) closeRotating() {
+	c.mut.Lock()
+	r := c.rotating
+	c.mut.Unlock()
+	if r == nil {
+		return
+	}
+	c.teeMut.Lock()
+	defer c.teeMut.Unlock()
+	if err := r.Close(); err != nil && c.teeErr == nil {
+		c.teeErr = fmt.Errorf("error in CaptureOuts.SetRotatingFile(): close failed with '%v'", err)
+	}
+}
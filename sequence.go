@@ -0,0 +1,46 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ExecSequence runs each of steps, a command and its
+// arguments, one after another, as the steps of a build, say,
+// capturing all their output into one continuous timeline:
+// before each step's output we store a synthetic line, from
+// the Marker stream, like
+//
+//	==> step 2/3: go test ./...
+//
+// so that a CI-style log pane can show the whole job as a
+// single transcript. It stops at the first step that fails,
+// whose error, saying which step it was, goes in c.Err. Like
+// Exec, it blocks until done, and then closes c.Done.
+func (c *CaptureOuts) ExecSequence(steps [][]string) error {
+	return c.finish(c.execSequence(steps))
+}
+
+func (c *CaptureOuts) execSequence(steps [][]string) error {
+	for i, args := range steps {
+		if len(args) == 0 {
+			return fmt.Errorf("error in CaptureOuts.ExecSequence(): %w with 'step %v is an empty command'", ErrStartFailed, i+1)
+		}
+	}
+	for i, args := range steps {
+		desc := strings.Join(args, " ")
+		c.addLine(fmt.Sprintf("==> step %v/%v: %v%c", i+1, len(steps), desc, c.delim), Marker, 0)
+		err := c.runOnce(context.Background(), "ExecSequence", c.execCommand(context.Background(), args[0], args[1:]...))
+		if err != nil {
+			// the step goes in both errors, so that a wrapper
+			// from SetErrorWrapper sees it too.
+			at := fmt.Sprintf("at step %v/%v: '%v'", i+1, len(steps), desc)
+			if se, ok := err.(*stageErr); ok {
+				return stageError(se.stage, fmt.Errorf("%w; %v", se.err, at), fmt.Errorf("%w; %v", se.ours, at))
+			}
+			return fmt.Errorf("%w; %v", err, at)
+		}
+	}
+	return nil
+}
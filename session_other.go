@@ -0,0 +1,27 @@
+//go:build !unix
+
+package capture
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// SetNewSession is only supported on Unix. Elsewhere, setting
+// it makes Exec fail to start the child.
+func (c *CaptureOuts) SetNewSession(on bool) {
+	c.mut.Lock()
+	c.newSession = on
+	c.mut.Unlock()
+}
+
+func (c *CaptureOuts) applySession(cmd *exec.Cmd) error {
+	c.mut.Lock()
+	on := c.newSession
+	c.mut.Unlock()
+	if !on {
+		return nil
+	}
+	return fmt.Errorf("SetNewSession is not supported on %v", runtime.GOOS)
+}
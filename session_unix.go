@@ -0,0 +1,42 @@
+//go:build unix
+
+package capture
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// SetNewSession(true) starts the child in a new session, with
+// setsid(2), so that it is detached from our controlling
+// terminal and, for instance, gets no SIGINT or SIGHUP from
+// it; as is wanted when spawning a background service. Its
+// stdout and stderr are still captured through pipes.
+//
+// The child also leads a new process group, whose id is its
+// pid; so syscall.Kill(-c.PID(), sig) signals it along with
+// any descendants that stayed in its group, whereas Signal and
+// the kills done on cancellation reach only the child itself.
+// PTY mode always starts a new session. SetNewSession is Unix
+// only; on other platforms Exec fails to start the child if it
+// is set. Call SetNewSession before Exec.
+func (c *CaptureOuts) SetNewSession(on bool) {
+	c.mut.Lock()
+	c.newSession = on
+	c.mut.Unlock()
+}
+
+// applySession sets cmd up for SetNewSession, if requested.
+func (c *CaptureOuts) applySession(cmd *exec.Cmd) error {
+	c.mut.Lock()
+	on := c.newSession
+	c.mut.Unlock()
+	if !on {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	return nil
+}
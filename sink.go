@@ -0,0 +1,34 @@
+package capture
+
+// LineSink receives each completed line as it is captured,
+// for callers that want to keep the output in their own
+// storage: a database, a bounded buffer, a broadcaster.
+// isStdErr is true for lines from stderr.
+type LineSink interface {
+	AddLine(text string, isStdErr bool)
+}
+
+// SetSink arranges for each line to also be handed to s as it
+// is captured, after the delimiter, blank line and byte limit
+// options have been applied. Calls to AddLine are serialized,
+// in the order the lines are stored, and happen on the
+// capture goroutines, so a slow sink slows capture. A panic
+// in AddLine is recovered and reported by CallbackErr().
+// nil removes the sink. See also SetSinkOnly.
+func (c *CaptureOuts) SetSink(s LineSink) {
+	c.mut.Lock()
+	c.sink = s
+	c.mut.Unlock()
+}
+
+// SetSinkOnly(true) stops us from keeping our own copy of
+// the lines once a sink is set with SetSink, to save memory
+// when the sink is where the output lives. The accessors such
+// as GetComboOutSoFar and Stats then see nothing, though
+// BytesReadStdout and BytesReadStderr still count what was
+// read.
+func (c *CaptureOuts) SetSinkOnly(only bool) {
+	c.mut.Lock()
+	c.sinkOnly = only
+	c.mut.Unlock()
+}
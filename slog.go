@@ -0,0 +1,102 @@
+package capture
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// slogQueueLen is how many lines may be waiting for a slow
+// slog handler before we start dropping them.
+const slogQueueLen = 4096
+
+type slogLine struct {
+	line   string
+	stream Stream
+}
+
+// SetSlogger arranges for each completed line to also be
+// logged to l, with the line (minus its trailing delimiter)
+// as the message, and the attributes cmd=<the command name>
+// and stream=stdout|stderr|stdin|merged|marker. Lines are
+// logged at slog.LevelInfo unless changed with SetSlogLevel.
+//
+// Logging happens on a separate goroutine, fed by a queue, so
+// a slow handler never blocks the capture goroutines. If the
+// queue fills up, further lines are not logged (they are
+// still captured as usual), and the number dropped is logged
+// as a warning when the process finishes. Exec does not
+// return, nor close c.Done, until the queue has been logged.
+// Call SetSlogger before Exec.
+func (c *CaptureOuts) SetSlogger(l *slog.Logger) {
+	c.mut.Lock()
+	c.slogger = l
+	c.mut.Unlock()
+}
+
+// SetSlogLevel sets the level at which SetSlogger logs lines.
+func (c *CaptureOuts) SetSlogLevel(level slog.Level) {
+	c.mut.Lock()
+	c.slogLevel = level
+	c.mut.Unlock()
+}
+
+// startSlogger starts the logging goroutine, if a logger
+// has been set. cmdName is used for the cmd attribute.
+func (c *CaptureOuts) startSlogger(cmdName string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.slogger == nil {
+		return
+	}
+	l := c.slogger.With("cmd", cmdName)
+	level := c.slogLevel
+	delim := string(c.delim)
+	ch := make(chan slogLine, slogQueueLen)
+	c.slogCh = ch
+	c.slogDone = make(chan struct{})
+
+	go func() {
+		defer close(c.slogDone)
+		ctx := context.Background()
+		for s := range ch {
+			stream := s.stream.String()
+			msg := strings.TrimSuffix(strings.TrimSuffix(s.line, delim), "\r")
+			c.safely("slog handler", func() { l.Log(ctx, level, msg, "stream", stream) })
+		}
+		c.mut.Lock()
+		dropped := c.slogDropped
+		c.mut.Unlock()
+		if dropped > 0 {
+			l.Warn("capture: slog handler too slow; some lines were not logged", "dropped", dropped)
+		}
+	}()
+}
+
+// logLine queues line for the slog goroutine, without
+// blocking. The caller must hold c.mut.
+func (c *CaptureOuts) logLine(line string, stream Stream) {
+	if c.slogCh == nil {
+		return
+	}
+	select {
+	case c.slogCh <- slogLine{line: line, stream: stream}:
+	default:
+		c.slogDropped++
+	}
+}
+
+// stopSlogger waits for the logging goroutine to finish
+// with the queue. Call it only after the capture goroutines
+// are done.
+func (c *CaptureOuts) stopSlogger() {
+	c.mut.Lock()
+	ch := c.slogCh
+	c.slogCh = nil
+	c.mut.Unlock()
+	if ch == nil {
+		return
+	}
+	close(ch)
+	<-c.slogDone
+}
@@ -0,0 +1,335 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Stream identifies where a captured line came from. It
+// replaces the older stdout/stderr bool, which remains
+// available, derived from the Stream, in GetComboOutSoFar.
+type Stream int
+
+const (
+	Stdout Stream = iota
+	Stderr
+	Stdin  // what we sent to the child, with SetStdinTee(true).
+	Merged // stdout and stderr together, as in PTY mode.
+	Marker // a line of our own, between ExecSequence steps.
+
+	numStreams
+)
+
+// isStdout reports whether s is, or includes, stdout. Those
+// accessors that want only stdout also take Merged lines,
+// since there the child's stdout cannot be separated out.
+func (s Stream) isStdout() bool {
+	return s == Stdout || s == Merged
+}
+
+func (s Stream) String() string {
+	switch s {
+	case Stdout:
+		return "stdout"
+	case Stderr:
+		return "stderr"
+	case Stdin:
+		return "stdin"
+	case Merged:
+		return "merged"
+	case Marker:
+		return "marker"
+	}
+	return "unknown"
+}
+
+// parseStream is the inverse of Stream.String.
+func parseStream(s string) Stream {
+	for a := Stdout; a < numStreams; a++ {
+		if a.String() == s {
+			return a
+		}
+	}
+	return Stdout
+}
+
+// GetComboOutSoFarStreams is like GetComboOutSoFar(true),
+// but reports the Stream each line came from, rather than
+// just whether it came from stderr.
+func (c *CaptureOuts) GetComboOutSoFarStreams() ([]string, []Stream) {
+	return c.linesSoFar()
+}
+
+// SetStdoutPassthrough(true) leaves the child's stdout
+// alone, rather than capturing it: it goes straight to our
+// os.Stdout (or to the writer given to SetStdoutPassthroughTo),
+// and only stderr is captured. This suits tools whose stdout
+// is the payload, meant for the user's terminal, while stderr
+// holds the diagnostics to collect and act on. In this mode
+// GetComboOutSoFar returns only stderr lines, and the child
+// may see a terminal on its stdout, since os.Stdout is handed
+// to it directly. It does not apply in PTY mode. Call it
+// before Exec.
+func (c *CaptureOuts) SetStdoutPassthrough(on bool) {
+	c.mut.Lock()
+	c.passthrough = on
+	c.mut.Unlock()
+}
+
+// SetStdoutPassthroughTo turns on SetStdoutPassthrough, with
+// the child's stdout going to w rather than os.Stdout. A w
+// that is not an *os.File is fed through a pipe, by a
+// goroutine of os/exec; nil means os.Stdout.
+func (c *CaptureOuts) SetStdoutPassthroughTo(w io.Writer) {
+	c.mut.Lock()
+	c.passthrough = true
+	c.passthroughTo = w
+	c.mut.Unlock()
+}
+
+// SetCountOnlyStdout(true) drains the child's stdout without
+// storing it, or even splitting it into lines, while still
+// counting its bytes in BytesReadStdout (and DeltaBytes and
+// OnRead); for a command run for its side effects and exit
+// code, where only the volume of its output matters. Stdout
+// lines are then not stored, nor handed to tee writers,
+// sinks or subscribers; stderr is captured as usual. It does
+// not apply in PTY mode, where stdout and stderr are merged.
+// Call it before Exec.
+func (c *CaptureOuts) SetCountOnlyStdout(on bool) {
+	c.mut.Lock()
+	c.countOnlyStdout = on
+	c.mut.Unlock()
+}
+
+// passthroughWriter returns where the child's stdout should
+// go, if not to us; else nil.
+func (c *CaptureOuts) passthroughWriter() io.Writer {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if !c.passthrough {
+		return nil
+	}
+	if c.passthroughTo != nil {
+		return c.passthroughTo
+	}
+	return os.Stdout
+}
+
+// SetKillOnStderr(true) treats any output on stderr as fatal,
+// as some build steps do: the moment the first stderr line is
+// captured, the process (every stage, in ExecPipeline) is
+// killed, and c.Err then wraps ErrStderrOutput, by way of a
+// *StderrOutputError carrying the offending line. Output
+// captured up to then, including that line, and any flushed
+// as the process dies, remains available. Call it before Exec.
+func (c *CaptureOuts) SetKillOnStderr(on bool) {
+	c.mut.Lock()
+	c.killOnStderr = on
+	c.mut.Unlock()
+}
+
+// killProcs kills the running process, or processes.
+func (c *CaptureOuts) killProcs() {
+	c.mut.Lock()
+	procs := append([]*exec.Cmd{c.cmd}, c.procs...)
+	c.mut.Unlock()
+	for _, p := range procs {
+		if p != nil && p.Process != nil {
+			p.Process.Kill()
+		}
+	}
+	c.closePipesLater(drainAfterKill)
+}
+
+// drainAfterKill is how long we keep reading a killed
+// process's output, before giving up on reaching EOF.
+const drainAfterKill = 500 * time.Millisecond
+
+// setPipes records our ends of the pipes about to be
+// captured, for closePipesLater.
+func (c *CaptureOuts) setPipes(pipes ...io.Reader) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.pipes = nil
+	for _, p := range pipes {
+		if cl, ok := p.(io.Closer); ok {
+			c.pipes = append(c.pipes, cl)
+		}
+	}
+}
+
+// closePipesLater closes our ends of the pipes being
+// captured, d from now, once the process has been killed.
+// Capture otherwise waits for EOF, which doesn't come while
+// any process the child started, like the command run by
+// "sh -c", still holds the pipes open; the same problem as
+// exec.Cmd's WaitDelay solves for its own pipe copying. What
+// the child wrote before it died is read within d; anything
+// its descendants write after that is lost. The reads then
+// fail with os.ErrClosed, which ends capture of that stream
+// like EOF.
+func (c *CaptureOuts) closePipesLater(d time.Duration) {
+	c.mut.Lock()
+	pipes := c.pipes
+	c.mut.Unlock()
+	if len(pipes) == 0 {
+		return
+	}
+	time.AfterFunc(d, func() {
+		// closing a pipe that cmd.Wait() has closed already
+		// does no harm.
+		for _, p := range pipes {
+			p.Close()
+		}
+	})
+}
+
+// stderrKillErr returns a *StderrOutputError if the process
+// was killed by SetKillOnStderr(true), or else nil.
+func (c *CaptureOuts) stderrKillErr() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.stderrKillLine == nil {
+		return nil
+	}
+	return &StderrOutputError{Line: *c.stderrKillLine}
+}
+
+// SetKillOnReadError(true) kills the process (every stage,
+// in ExecPipeline) if reading its stdout or stderr fails with
+// an error other than io.EOF. Without it, a child that keeps
+// writing to the pipe we can no longer read may block, and
+// so never exit. Either way, c.Err reports the read error,
+// wrapping ErrReadFailed. Should the process also exit with
+// an error, as when it was killed, that takes precedence:
+// c.Err wraps ErrWaitFailed and the exit error first, and
+// the read error second. Call it before Exec.
+func (c *CaptureOuts) SetKillOnReadError(on bool) {
+	c.mut.Lock()
+	c.killOnReadError = on
+	c.mut.Unlock()
+}
+
+// noteReadError records err, from reading stream a, if it is
+// the first, and kills the process if SetKillOnReadError.
+func (c *CaptureOuts) noteReadError(a Stream, err error) {
+	if errors.Is(err, os.ErrClosed) {
+		// closePipesLater closed the pipe: not a failure.
+		return
+	}
+	c.mut.Lock()
+	first := c.readErr == nil
+	if first {
+		c.readErr = fmt.Errorf("%v: %w", a, err)
+	}
+	kill := first && c.killOnReadError
+	c.mut.Unlock()
+	if kill {
+		c.killProcs()
+	}
+}
+
+// readError returns the first error from reading the output,
+// other than io.EOF, if any.
+func (c *CaptureOuts) readError() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.readErr
+}
+
+// SetStdin arranges for the child to read its stdin from r,
+// rather than from the null device. r is consumed by the
+// first run of the command; so with ExecRetry, later attempts
+// see whatever is left of it. Call SetStdin before Exec.
+func (c *CaptureOuts) SetStdin(r io.Reader) {
+	c.mut.Lock()
+	c.stdin = r
+	c.mut.Unlock()
+}
+
+// SetStdinFile opens the file at path, and arranges for the
+// child to read its stdin from it, as with SetStdin; for the
+// common "feed this file to the command" case. The file is
+// closed once the process has finished (when c.Done is
+// closed), or if SetStdinFile is called again. If the file
+// can't be opened, SetStdinFile returns the error, and
+// leaves stdin as it was. Call it before Exec.
+func (c *CaptureOuts) SetStdinFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error in CaptureOuts.SetStdinFile(): %w", err)
+	}
+	c.mut.Lock()
+	old := c.stdinFile
+	c.stdin = f
+	c.stdinFile = f
+	c.mut.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// closeStdinFile closes the file opened by SetStdinFile, if
+// any.
+func (c *CaptureOuts) closeStdinFile() {
+	c.mut.Lock()
+	f := c.stdinFile
+	c.stdinFile = nil
+	c.mut.Unlock()
+	if f != nil {
+		f.Close()
+	}
+}
+
+// SetStdinTee(true) arranges for the bytes sent to the child's
+// stdin (see SetStdin) to be captured too, as lines tagged with
+// the Stdin stream, interleaved with the child's output in the
+// order they were sent. This gives a complete transcript of a
+// request/response style conversation with the child. In the
+// []bool returned by GetComboOutSoFar(true), stdin lines are
+// reported as not from stderr, just like stdout lines; use
+// GetComboOutSoFarStreams to tell them apart. Call
+// SetStdinTee before Exec.
+func (c *CaptureOuts) SetStdinTee(tee bool) {
+	c.mut.Lock()
+	c.stdinTee = tee
+	c.mut.Unlock()
+}
+
+// setupStdin connects cmd.Stdin as requested by SetStdin and
+// SetStdinTee. The returned done function must be called after
+// cmd.Wait() has returned, and waits for the stdin tee, if
+// any, to finish storing what was sent.
+func (c *CaptureOuts) setupStdin(cmd *exec.Cmd) (done func()) {
+	c.mut.Lock()
+	r := c.stdin
+	tee := c.stdinTee
+	c.mut.Unlock()
+
+	if r == nil {
+		return func() {}
+	}
+	if !tee {
+		cmd.Stdin = r
+		return func() {}
+	}
+	// cmd.Wait() waits for exec's goroutine copying from
+	// cmd.Stdin to the child, and so for all writes to pw.
+	// The child may exit without reading all of r, so we
+	// close pw only then, rather than at the EOF of r.
+	pr, pw := io.Pipe()
+	cmd.Stdin = io.TeeReader(r, pw)
+	var wg sync.WaitGroup
+	c.captureWG(pr, Stdin, 0, &wg)
+	return func() {
+		pw.Close()
+		wg.Wait()
+	}
+}
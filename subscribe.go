@@ -0,0 +1,210 @@
+package capture
+
+import (
+	"fmt"
+	"sync"
+)
+
+// subscriber is one Subscribe call's channel.
+type subscriber struct {
+	ch   chan Line
+	quit chan struct{} // closed by the cancel func.
+}
+
+// bcastMsg is what the broadcaster goroutine acts on: a line
+// to deliver, or a change to the set of subscribers.
+type bcastMsg struct {
+	line     Line
+	add      *subscriber
+	backlog  []Line // for add, delivered to it first.
+	remove   *subscriber
+	closeAll bool // capture is complete.
+}
+
+// subscribeBuffer is the capacity of each subscriber's channel,
+// and bcastBuffer that of the channel to the broadcaster.
+const (
+	subscribeBuffer = 256
+	bcastBuffer     = 1024
+)
+
+// Subscribe returns a channel on which each line captured
+// from now on is delivered, in capture order, and a cancel
+// func to unsubscribe. The channel is closed after the last
+// line, once capture is complete, or by cancel. Lines that
+// were captured before the call are not delivered, except
+// with SetBufferUntilSubscribed(true), where the first
+// subscriber gets them all.
+//
+// A single broadcaster goroutine delivers to all the
+// subscribers, so capturing a line costs the same one channel
+// send however many there are; c.Done may be closed before
+// every subscriber has read its last lines. A subscriber that
+// stops reading without calling cancel holds up the others,
+// and, once the buffers fill, capture.
+//
+// With SetMaxSubscribers(n), once n subscriptions are active,
+// further ones get a channel that is already closed.
+func (c *CaptureOuts) Subscribe() (<-chan Line, func()) {
+	lines, cancel, _ := c.subscribe()
+	return lines, cancel
+}
+
+// subscribe is Subscribe, also returning an error when the
+// SetMaxSubscribers limit was reached.
+func (c *CaptureOuts) subscribe() (<-chan Line, func(), error) {
+	sub := &subscriber{
+		ch:   make(chan Line, subscribeBuffer),
+		quit: make(chan struct{}),
+	}
+
+	c.mut.Lock()
+	if c.maxSubs > 0 && c.nsubs >= c.maxSubs {
+		err := fmt.Errorf("already %v subscribers, the SetMaxSubscribers limit", c.nsubs)
+		c.mut.Unlock()
+		close(sub.ch)
+		return sub.ch, func() {}, err
+	}
+	var backlog []Line
+	if c.bufferUntilSub && !c.handedOff {
+		c.handedOff = true
+		backlog = make([]Line, len(c.lines))
+		for i := range backlog {
+			backlog[i] = c.lineAt(i)
+		}
+		c.droppedLines += len(c.lines)
+		c.lines, c.streams, c.times, c.stages, c.counts = nil, nil, nil, nil, nil
+		c.offsets = nil
+		c.tailHeld = 0
+	}
+	if c.subsClosed {
+		c.mut.Unlock()
+		go func() {
+			defer close(sub.ch)
+			for _, ln := range backlog {
+				if !sub.send(ln) {
+					return
+				}
+			}
+		}()
+		return sub.ch, func() {}, nil
+	}
+	if c.bcast == nil {
+		c.bcast = make(chan bcastMsg, bcastBuffer)
+		go broadcast(c.bcast)
+	}
+	c.nsubs++
+	bcast := c.bcast
+	// under teeMut, so sub is added in order with the lines.
+	c.teeMut.Lock()
+	c.mut.Unlock()
+	bcast <- bcastMsg{add: sub, backlog: backlog}
+	c.teeMut.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(sub.quit)
+			c.mut.Lock()
+			if c.subsClosed {
+				// the broadcaster has closed, or will close, sub.ch.
+				c.mut.Unlock()
+				return
+			}
+			c.nsubs--
+			c.teeMut.Lock()
+			c.mut.Unlock()
+			bcast <- bcastMsg{remove: sub}
+			c.teeMut.Unlock()
+		})
+	}
+	return sub.ch, cancel, nil
+}
+
+// SetMaxSubscribers limits the number of active Subscribe
+// subscriptions to n; 0, the default, means no limit.
+func (c *CaptureOuts) SetMaxSubscribers(n int) {
+	c.mut.Lock()
+	c.maxSubs = n
+	c.mut.Unlock()
+}
+
+// SetBufferUntilSubscribed(true) suits a consumer that is
+// sure to Subscribe, but perhaps only after the process has
+// started: output is stored as usual until the first
+// Subscribe call, which receives all of it, and from then on
+// is only streamed to subscribers, not stored. The handoff
+// empties the store, so that memory use no longer grows;
+// after it, accessors such as GetComboOutSoFar see nothing.
+// Later subscribers get only the lines that follow their own
+// Subscribe call. Call it before Exec.
+func (c *CaptureOuts) SetBufferUntilSubscribed(on bool) {
+	c.mut.Lock()
+	c.bufferUntilSub = on
+	c.mut.Unlock()
+}
+
+// send delivers ln to sub, blocking until sub has room or
+// is cancelled; it reports false if sub is cancelled.
+func (sub *subscriber) send(ln Line) bool {
+	select {
+	case sub.ch <- ln:
+		return true
+	case <-sub.quit:
+		return false
+	}
+}
+
+// broadcast is the broadcaster goroutine. It alone touches
+// the subscribers' channels, delivering each line from in to
+// all of them, until told capture is complete.
+func broadcast(in <-chan bcastMsg) {
+	var subs []*subscriber
+	for m := range in {
+		switch {
+		case m.add != nil:
+			subs = append(subs, m.add)
+			for _, ln := range m.backlog {
+				if !m.add.send(ln) {
+					break
+				}
+			}
+		case m.remove != nil:
+			for i, s := range subs {
+				if s == m.remove {
+					subs = append(subs[:i], subs[i+1:]...)
+					close(s.ch)
+					break
+				}
+			}
+		case m.closeAll:
+			for _, s := range subs {
+				close(s.ch)
+			}
+			return
+		default:
+			for _, s := range subs {
+				s.send(m.line)
+			}
+		}
+	}
+}
+
+// closeSubs tells the broadcaster, if any, that capture is
+// complete, so it closes the subscribers' channels after the
+// last line; later subscribers get a closed channel.
+func (c *CaptureOuts) closeSubs() {
+	c.mut.Lock()
+	if c.subsClosed {
+		c.mut.Unlock()
+		return
+	}
+	c.subsClosed = true
+	bcast := c.bcast
+	c.teeMut.Lock()
+	c.mut.Unlock()
+	defer c.teeMut.Unlock()
+	if bcast != nil {
+		bcast <- bcastMsg{closeAll: true}
+	}
+}
@@ -0,0 +1,45 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Supervise runs the command, and, whenever it exits while
+// ctx is still active, runs it again after restartDelay: a
+// keep-alive supervisor for a long-lived service. The output
+// of every run accumulates in c, with a synthetic line from
+// the Marker stream, like
+//
+//	==> restarted (1), after exit status 1
+//
+// before the output of each restart. Cancelling ctx kills the
+// running child, as in ExecContext, and ends supervision;
+// c.Err then wraps ctx.Err(). A command that cannot be
+// started at all is not retried, and its error goes in c.Err.
+// Supervise blocks until it is done, and then closes c.Done.
+func (c *CaptureOuts) Supervise(ctx context.Context, restartDelay time.Duration, arg0 string, args ...string) {
+	c.finish(c.supervise(ctx, restartDelay, arg0, args))
+}
+
+func (c *CaptureOuts) supervise(ctx context.Context, restartDelay time.Duration, arg0 string, args []string) error {
+	for restarts := 0; ; restarts++ {
+		cmd := c.execCommand(ctx, arg0, args...)
+		err := c.runOnce(ctx, "Supervise", cmd)
+		if stage := failedStage(err); ctx.Err() != nil || stage == "start" || stage == "context" {
+			// done; or SetCancelChan's channel was closed.
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return stageError("context", ctx.Err(), fmt.Errorf("error in CaptureOuts.Supervise(): context done with '%w' before a restart", ctx.Err()))
+		case <-time.After(restartDelay):
+		}
+		why := "it exited"
+		if cmd.ProcessState != nil {
+			why = cmd.ProcessState.String()
+		}
+		c.addLine(fmt.Sprintf("==> restarted (%v), after %v%c", restarts+1, why, c.delim), Marker, 0)
+	}
+}
@@ -0,0 +1,294 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// SetTeeCombined arranges for each completed line, from
+// either stream, to also be written to w as it is captured,
+// in the same order as the lines are stored; for forwarding
+// live output to a log or a client. Writes happen on the
+// capture goroutines, so a slow w slows capture. It can also
+// hold up the accessors: to keep w's lines in order, a line
+// from one stream waits, with c's lock held, for the write
+// of the line before it, from the other stream, to finish;
+// as does a flush from SetTeeFlushInterval. So a w that may
+// block for long, such as a network client, should be
+// buffered, or given a goroutine of its own. Write errors
+// do not stop capture; the first one is available from
+// TeeErr(), and SetTeeErrorPolicy can say what else to do.
+// nil removes the tee.
+func (c *CaptureOuts) SetTeeCombined(w io.Writer) {
+	c.mut.Lock()
+	c.teeCombined = w
+	c.mut.Unlock()
+}
+
+// SwapTeeCombined replaces the writer of SetTeeCombined with
+// w, while the process runs, and returns the old one, for a
+// supervisor that rotates the destination itself. Every line
+// goes to exactly one of the two: the lines captured before
+// the swap to the old writer, and those after to w. Once
+// SwapTeeCombined returns, the old writer is never written to
+// (or flushed) again, so the caller may flush and close it.
+// nil for w removes the tee.
+func (c *CaptureOuts) SwapTeeCombined(w io.Writer) io.Writer {
+	c.mut.Lock()
+	old := c.teeCombined
+	c.teeCombined = w
+	// addLine takes teeMut before releasing mut, so any line
+	// bound for old is being written by now, or has been;
+	// wait for that.
+	c.teeMut.Lock()
+	c.mut.Unlock()
+	c.teeMut.Unlock()
+	return old
+}
+
+// SetStdoutSink arranges for each line from the child's
+// stdout (or, in PTY mode, its merged output) to be written
+// to w as it is captured, exactly as it would be stored; for
+// streaming stdout to a client. With keepInMemory, the lines
+// are stored as usual too, say for a client that reconnects;
+// without it, only stderr is stored. Writes happen in capture
+// order on the capture goroutines, serialized with the tee
+// writes, and their errors are reported by TeeErr(). nil
+// removes the sink. Call it before Exec.
+func (c *CaptureOuts) SetStdoutSink(w io.Writer, keepInMemory bool) {
+	c.mut.Lock()
+	c.stdoutSink = w
+	c.stdoutSinkKeep = keepInMemory
+	c.mut.Unlock()
+}
+
+// SetCombinedBuilder arranges for each completed line, from
+// either stream, to be appended to sb as it is captured, so
+// that the combined output is built up as we go, rather than
+// joined from the lines at the end. Collapsed repeats and
+// lines not kept in memory are appended all the same. sb is
+// written while c's lock is held, which the caller cannot
+// take, so sb must not be read or written by anyone else
+// until capture is over (once Done is closed), or until
+// SetCombinedBuilder(nil), after which c never touches sb
+// again, has returned. Call it before Exec.
+func (c *CaptureOuts) SetCombinedBuilder(sb *strings.Builder) {
+	c.mut.Lock()
+	c.builder = sb
+	c.mut.Unlock()
+}
+
+// TeeErrorPolicy says what to do when writing to a tee
+// writer fails, as when it is a pipe or a socket whose
+// reader has gone away; see SetTeeErrorPolicy.
+type TeeErrorPolicy int
+
+const (
+	// Ignore carries on writing each line to every tee
+	// writer, whatever errors they give. The default.
+	Ignore TeeErrorPolicy = iota
+
+	// StopTee stops writing to the tee writers after the
+	// first error. Capture carries on as usual.
+	StopTee
+
+	// KillProcess stops writing to the tee writers after the
+	// first error, and kills the process (every stage, in
+	// ExecPipeline); c.Err then reports it was killed.
+	KillProcess
+)
+
+// SetTeeErrorPolicy chooses what happens once writing to a
+// tee writer fails: one of SetTeeCombined, SetStdoutSink,
+// StreamNDJSON or SetRotatingFile, or a Flush of one. With
+// StopTee or KillProcess, that first failure ends the writes
+// to all of them, not just to the one that failed; the
+// failure itself is reported by TeeErr(), as ever. For a
+// client that has disconnected, StopTee or KillProcess saves
+// erroring on every later line. The writers of
+// SetStdoutPassthroughTo are not tee writers, and are not
+// affected. Call it before Exec.
+func (c *CaptureOuts) SetTeeErrorPolicy(policy TeeErrorPolicy) {
+	c.mut.Lock()
+	c.teePolicy = policy
+	c.mut.Unlock()
+}
+
+// TeeErr returns the first error from writing to a tee
+// writer, if any.
+func (c *CaptureOuts) TeeErr() error {
+	c.teeMut.Lock()
+	defer c.teeMut.Unlock()
+	return c.teeErr
+}
+
+// SetTeeFlushInterval arranges, while the process runs, for
+// Flush() to be called every d on any tee writer that has a
+// Flush() error method, such as a *bufio.Writer: those given
+// to SetTeeCombined, SetStdoutSink and StreamNDJSON; so that
+// forwarded output doesn't sit unflushed in its buffer. A
+// final Flush() is done once capture is complete. d <= 0,
+// the default, means we never call Flush(). Call
+// SetTeeFlushInterval before Exec.
+func (c *CaptureOuts) SetTeeFlushInterval(d time.Duration) {
+	c.mut.Lock()
+	c.teeFlushInterval = d
+	c.mut.Unlock()
+}
+
+// StreamNDJSON arranges for each line to be written to w as
+// a newline terminated JSON object, as it is captured:
+//
+//	{"stream":"stdout","text":"hello\n","seq":0}
+//
+// where seq counts the lines captured, from 0, each repeat
+// of SetCollapseRepeats included. (This is the line's index
+// in GetComboOutSoFar, unless older lines have since been
+// evicted, as by SetTailBytes.) Lines
+// captured before the call are written first, so that a
+// tailer of w sees the whole capture, in order, with no gaps
+// or duplicates. Writes are serialized with the tee writes,
+// in capture order. Unlike a batch dump, this lets a log
+// shipper consume the output in real time. Write errors are
+// available from TeeErr(). nil stops the stream.
+func (c *CaptureOuts) StreamNDJSON(w io.Writer) {
+	c.mut.Lock()
+	c.ndjson = w
+	if w == nil {
+		c.mut.Unlock()
+		return
+	}
+	lines := c.lines[:len(c.lines):len(c.lines)]
+	streams := c.streams[:len(c.streams):len(c.streams)]
+	counts := make([]int, len(lines))
+	seq := c.lineSeq
+	for i := range counts {
+		counts[i] = c.repeats(i)
+		seq -= counts[i]
+	}
+	c.teeMut.Lock()
+	c.mut.Unlock()
+
+	defer c.teeMut.Unlock()
+	for i, line := range lines {
+		for k := counts[i]; k > 0; k-- {
+			c.writeNDJSON(w, line, streams[i], seq)
+			seq++
+		}
+	}
+}
+
+type ndjsonLine struct {
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+	Seq    int    `json:"seq"`
+}
+
+// writeNDJSON writes line to w as a JSON object. The
+// caller must hold c.teeMut.
+func (c *CaptureOuts) writeNDJSON(w io.Writer, line string, stream Stream, seq int) {
+	b, err := json.Marshal(ndjsonLine{Stream: stream.String(), Text: line, Seq: seq})
+	if err == nil {
+		c.safely("StreamNDJSON writer", func() { _, err = w.Write(append(b, '\n')) })
+	}
+	if err != nil && c.teeErr == nil {
+		c.teeErr = fmt.Errorf("error in CaptureOuts.StreamNDJSON(): write failed with '%v'", err)
+	}
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// writeTee writes line to w. The caller must hold c.teeMut.
+func (c *CaptureOuts) writeTee(w io.Writer, line string) {
+	var err error
+	c.safely("tee writer", func() { _, err = io.WriteString(w, line) })
+	if err != nil && c.teeErr == nil {
+		c.teeErr = fmt.Errorf("error in CaptureOuts tee: write failed with '%v'", err)
+	}
+}
+
+// writeStdoutSink writes line to the writer of SetStdoutSink.
+// The caller must hold c.teeMut.
+func (c *CaptureOuts) writeStdoutSink(w io.Writer, line string) {
+	var err error
+	c.safely("stdout sink", func() { _, err = io.WriteString(w, line) })
+	if err != nil && c.teeErr == nil {
+		c.teeErr = fmt.Errorf("error in CaptureOuts.SetStdoutSink(): write failed with '%v'", err)
+	}
+}
+
+// writeRotating writes line to the file of SetRotatingFile.
+// The caller must hold c.teeMut.
+func (c *CaptureOuts) writeRotating(r *rotatingFile, line string) {
+	_, err := io.WriteString(r, line)
+	if err != nil && c.teeErr == nil {
+		c.teeErr = fmt.Errorf("error in CaptureOuts.SetRotatingFile(): write failed with '%v'", err)
+	}
+}
+
+// flushTees calls Flush() on the tee writers that have one:
+// those of SetTeeCombined, SetStdoutSink and StreamNDJSON.
+// (SetRotatingFile's file is not buffered.)
+func (c *CaptureOuts) flushTees() {
+	c.mut.Lock()
+	var fs []flusher
+	for _, w := range []io.Writer{c.teeCombined, c.stdoutSink, c.ndjson} {
+		if f, ok := w.(flusher); ok {
+			fs = append(fs, f)
+		}
+	}
+	if len(fs) == 0 {
+		c.mut.Unlock()
+		return
+	}
+	// take teeMut before releasing mut, so that
+	// SwapTeeCombined can't return while we flush the
+	// writer it swapped out.
+	c.teeMut.Lock()
+	c.mut.Unlock()
+	defer c.teeMut.Unlock()
+	for _, f := range fs {
+		var err error
+		c.safely("tee writer Flush", func() { err = f.Flush() })
+		if err != nil && c.teeErr == nil {
+			c.teeErr = fmt.Errorf("error in CaptureOuts tee: flush failed with '%v'", err)
+		}
+	}
+}
+
+// startTeeFlusher starts the periodic flushing requested by
+// SetTeeFlushInterval, if any. The returned stop function
+// ends it, doing a final flush.
+func (c *CaptureOuts) startTeeFlusher() (stop func()) {
+	c.mut.Lock()
+	d := c.teeFlushInterval
+	c.mut.Unlock()
+	if d <= 0 {
+		return func() {}
+	}
+	halt := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(d)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				c.flushTees()
+			case <-halt:
+				c.flushTees()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(halt)
+		<-done
+	}
+}
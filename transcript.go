@@ -0,0 +1,164 @@
+package capture
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const transcriptMagic = "# capture transcript v1"
+
+// RunTimes returns when the process started, and when its
+// capture completed; each is zero until then.
+func (c *CaptureOuts) RunTimes() (start, end time.Time) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.startTime, c.endTime
+}
+
+// WriteTranscript writes a self-describing, human readable
+// transcript of the run to w, for archiving a complete
+// command execution as an artifact: a header giving the
+// command, start and end times, exit code and error, the
+// delimiter and whether SetTrimNewline was on, and then the
+// captured lines, in order, each tagged with its stream;
+// strings are quoted as in Go source, like
+//
+//	# capture transcript v1
+//	# command: "ls -l /nope"
+//	# start: 2024-05-01T10:00:00.123456789Z
+//	# end: 2024-05-01T10:00:00.125Z
+//	# exit code: 2
+//	# err: "error in CaptureOuts.Exec(): ..."
+//	# delimiter: "\n"
+//	# trim newline: false
+//	# lines: 1
+//	stderr "ls: cannot access '/nope': No such file or directory\n"
+//
+// With SetCollapseRepeats, a line that repeated is written
+// once, with its count after the stream, as in
+// stdout x3 "again\n". ReadTranscript reconstructs a
+// CaptureOuts from it. Call it after c.Done is closed to
+// record the whole run.
+func (c *CaptureOuts) WriteTranscript(w io.Writer) error {
+	var b strings.Builder
+	c.mut.Lock()
+	fmt.Fprintf(&b, "%v\n", transcriptMagic)
+	fmt.Fprintf(&b, "# command: %v\n", strconv.Quote(c.cmdLine))
+	if !c.startTime.IsZero() {
+		fmt.Fprintf(&b, "# start: %v\n", c.startTime.Format(time.RFC3339Nano))
+	}
+	if !c.endTime.IsZero() {
+		fmt.Fprintf(&b, "# end: %v\n", c.endTime.Format(time.RFC3339Nano))
+	}
+	fmt.Fprintf(&b, "# exit code: %v\n", c.exitCode)
+	if c.isDone() && c.Err != nil {
+		fmt.Fprintf(&b, "# err: %v\n", strconv.Quote(c.Err.Error()))
+	}
+	fmt.Fprintf(&b, "# delimiter: %v\n", strconv.Quote(string(c.delim)))
+	fmt.Fprintf(&b, "# trim newline: %v\n", c.trimNewline)
+	fmt.Fprintf(&b, "# lines: %v\n", len(c.lines))
+	for i, line := range c.lines {
+		if k := c.repeats(i); k > 1 {
+			fmt.Fprintf(&b, "%v x%v %v\n", c.streams[i], k, strconv.Quote(line))
+		} else {
+			fmt.Fprintf(&b, "%v %v\n", c.streams[i], strconv.Quote(line))
+		}
+	}
+	c.mut.Unlock()
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("error in CaptureOuts.WriteTranscript(): %w", err)
+	}
+	return nil
+}
+
+// ReadTranscript parses a transcript written by
+// WriteTranscript, and returns a complete CaptureOuts holding
+// the recorded lines, command, exit code, error and run times,
+// as Replay does for a Record recording.
+func ReadTranscript(r io.Reader) (*CaptureOuts, error) {
+	c := NewCaptureOuts()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<30)
+	fail := func(n int, format string, args ...any) (*CaptureOuts, error) {
+		return nil, fmt.Errorf("error in ReadTranscript(): line %v: %v", n, fmt.Sprintf(format, args...))
+	}
+	want := -1
+	var lines []recordLine
+	for n := 1; sc.Scan(); n++ {
+		text := sc.Text()
+		if n == 1 {
+			if text != transcriptMagic {
+				return fail(n, "not a capture transcript")
+			}
+			continue
+		}
+		if key, val, ok := strings.Cut(strings.TrimPrefix(text, "# "), ": "); ok && strings.HasPrefix(text, "# ") {
+			var err error
+			switch key {
+			case "command":
+				c.cmdLine, err = strconv.Unquote(val)
+			case "start":
+				c.startTime, err = time.Parse(time.RFC3339Nano, val)
+			case "end":
+				c.endTime, err = time.Parse(time.RFC3339Nano, val)
+			case "exit code":
+				c.exitCode, err = strconv.Atoi(val)
+			case "err":
+				var msg string
+				msg, err = strconv.Unquote(val)
+				c.Err = errors.New(msg)
+			case "delimiter":
+				var delim string
+				delim, err = strconv.Unquote(val)
+				if err == nil && len(delim) != 1 {
+					err = fmt.Errorf("want a single byte, got %q", delim)
+				}
+				if err == nil {
+					c.delim = delim[0]
+				}
+			case "trim newline":
+				c.trimNewline, err = strconv.ParseBool(val)
+			case "lines":
+				want, err = strconv.Atoi(val)
+			}
+			if err != nil {
+				return fail(n, "bad %v: %v", key, err)
+			}
+			continue
+		}
+		stream, quoted, ok := strings.Cut(text, " ")
+		if !ok {
+			return fail(n, "no stream tag")
+		}
+		count := 0
+		if rep, rest, ok := strings.Cut(quoted, " "); ok && strings.HasPrefix(rep, "x") {
+			var err error
+			if count, err = strconv.Atoi(rep[1:]); err != nil || count < 1 {
+				return fail(n, "bad repeat count %q", rep)
+			}
+			quoted = rest
+		}
+		line, err := strconv.Unquote(quoted)
+		if err != nil {
+			return fail(n, "bad quoted line: %v", err)
+		}
+		lines = append(lines, recordLine{Stream: stream, Text: line, Count: count})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error in ReadTranscript(): %w", err)
+	}
+	if want < 0 {
+		return nil, fmt.Errorf("error in ReadTranscript(): not a capture transcript, or header missing")
+	}
+	if len(lines) != want {
+		return nil, fmt.Errorf("error in ReadTranscript(): transcript truncated: got %v of %v lines", len(lines), want)
+	}
+	c.restore(lines)
+	return c, nil
+}
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package capture
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// SetUmask is only supported on Unix. Elsewhere, setting a
+// umask makes Exec fail to start the child.
+func (c *CaptureOuts) SetUmask(mask int) {
+	c.mut.Lock()
+	c.umask = mask
+	c.mut.Unlock()
+}
+
+func (c *CaptureOuts) withUmask(start func() error) error {
+	c.mut.Lock()
+	mask := c.umask
+	c.mut.Unlock()
+	if mask < 0 {
+		return start()
+	}
+	return fmt.Errorf("SetUmask is not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package capture
+
+import (
+	"sync"
+	"syscall"
+)
+
+// SetUmask arranges for the child to run with the given file
+// mode creation mask (e.g. 0o022), so that files it creates
+// get the intended permissions.
+//
+// Go offers no hook to run code between fork and exec, and
+// the child inherits the umask of its parent, so we set our
+// own umask to mask just while starting the child, and then
+// put it back. The umask is process-wide: files created by
+// other goroutines at that moment get it too. Starts from
+// CaptureOuts that set a umask are serialized, so that they
+// cannot see each other's. The child itself runs unchanged,
+// with the same path, arguments and environment. SetUmask
+// is Unix only; on other platforms Exec fails to start the
+// child if a umask was set. Call SetUmask before Exec.
+func (c *CaptureOuts) SetUmask(mask int) {
+	c.mut.Lock()
+	c.umask = mask
+	c.mut.Unlock()
+}
+
+// umaskMut serializes the setting and restoring of the
+// process umask by withUmask.
+var umaskMut sync.Mutex
+
+// withUmask calls start with the process umask set to the
+// one requested by SetUmask, if any.
+func (c *CaptureOuts) withUmask(start func() error) error {
+	c.mut.Lock()
+	mask := c.umask
+	c.mut.Unlock()
+	if mask < 0 {
+		return start()
+	}
+	umaskMut.Lock()
+	defer umaskMut.Unlock()
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return start()
+}
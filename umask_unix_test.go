@@ -0,0 +1,33 @@
+//go:build unix
+
+package capture
+
+import (
+	"os/exec"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestSetUmask(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	c := NewCaptureOuts()
+	c.SetUmask(0o027)
+	if err := c.Exec("sh", "-c", "umask"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.BytesSoFar()); got != "0027\n" {
+		t.Errorf("child's umask is %q, want 0027", got)
+	}
+	if args := c.cmd.Args; !reflect.DeepEqual(args, []string{"sh", "-c", "umask"}) {
+		t.Errorf("command rewritten to %q", args)
+	}
+	// ours is put back.
+	old := syscall.Umask(0o022)
+	syscall.Umask(old)
+	if old == 0o027 {
+		t.Errorf("our umask was left at %04o", old)
+	}
+}